@@ -0,0 +1,163 @@
+package beyond
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dghubble/sessions"
+	cache "github.com/patrickmn/go-cache"
+	"gopkg.in/go-jose/go-jose.v2/jwt"
+)
+
+var errGrantExpired = errors.New("login code expired")
+
+// accessClaims are the identity claims of a bearer token that beyond issues
+// to CLIs
+type accessClaims struct {
+	Email    string   `json:"email"`
+	Groups   []string `json:"groups,omitempty"`
+	AuthTime int64    `json:"auth_time"`
+	Session  string   `json:"sid,omitempty"`
+	TokenUse string   `json:"token_use"`
+}
+
+// accessGrant is the signed-in session a bearer token is issued for
+type accessGrant struct {
+	User     string
+	Groups   []string
+	AuthTime int64
+
+	// Session is the server-side session ID, when a backend is configured
+	Session string
+	// Until is when -session-lifetime ends the session, or zero
+	Until int64
+}
+
+// accessGrantFrom describes the session approving a bearer token
+func accessGrantFrom(session *sessions.Session) accessGrant {
+	grant := accessGrant{}
+	grant.User, _ = session.Values["user"].(string)
+	grant.Groups, _ = session.Values["groups"].([]string)
+	grant.AuthTime, _ = session.Values["auth_time"].(int64)
+	grant.Session, _ = session.Values["sid"].(string)
+	if *sessionMaxAge > 0 {
+		grant.Until = time.Unix(sessionLoginTime(session.Values), 0).Add(*sessionMaxAge).Unix()
+	}
+	return grant
+}
+
+// accessToken issues a bearer token for the grant. Its lifetime is ttl, cut
+// short when the session would end sooner.
+func accessToken(grant accessGrant, ttl time.Duration) (string, time.Duration, error) {
+	now := time.Now()
+	if grant.Until > 0 {
+		ttl = min(ttl, time.Unix(grant.Until, 0).Sub(now).Truncate(time.Second))
+	}
+	if ttl <= 0 {
+		return "", 0, errSessionNotFound
+	}
+	id, err := randhex32()
+	if err != nil {
+		return "", 0, err
+	}
+	token, err := signJWT(jwt.Claims{
+		Issuer:   "https://" + *host,
+		Subject:  grant.User,
+		Audience: jwt.Audience{"https://" + *host},
+		Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt: jwt.NewNumericDate(now),
+		ID:       id,
+	}, accessClaims{Email: grant.User, Groups: grant.Groups, AuthTime: grant.AuthTime, Session: grant.Session, TokenUse: "access"})
+	return token, ttl, err
+}
+
+// accessTokenUser returns the identity of a bearer token issued by the
+// device flow or /token, if any. With a server-side session backend, the
+// token is only valid while the session it was issued for is.
+func accessTokenUser(r *http.Request) (string, []string, int64) {
+	if !*deviceFlow && !*cliLogin {
+		return "", nil, 0
+	}
+	token := tokenFromRequest(r)
+	if strings.Count(token, ".") != 2 {
+		return "", nil, 0
+	}
+	extra := &accessClaims{}
+	claims, err := verifyJWT(token, jwt.Expected{Issuer: "https://" + *host, Audience: jwt.Audience{"https://" + *host}}, extra)
+	if err != nil || extra.TokenUse != "access" {
+		return "", nil, 0
+	}
+	if extra.Session != "" && store.backend != nil {
+		values, err := store.backend.Load(extra.Session)
+		if err != nil {
+			return "", nil, 0
+		}
+		if user, _ := values["user"].(string); user != claims.Subject {
+			return "", nil, 0
+		}
+		if _, ok := sessionLimits(values, time.Now()); !ok {
+			return "", nil, 0
+		}
+	}
+	return claims.Subject, extra.Groups, extra.AuthTime
+}
+
+// accessTokenStrip keeps a bearer token issued by beyond from reaching
+// backends, like the session cookie
+func accessTokenStrip(r *http.Request) {
+	r.Header.Del("Authorization")
+	if q := r.URL.Query(); q.Has("access_token") {
+		q.Del("access_token")
+		r.URL.RawQuery = q.Encode()
+		r.RequestURI = r.URL.RequestURI()
+	}
+}
+
+// grantLoad reads a pending login code from the session backend when one is
+// configured, so a CLI may continue its login on any instance, and from the
+// local cache otherwise
+func grantLoad(local *cache.Cache, key string) (string, bool) {
+	if store.backend == nil {
+		v, ok := local.Get(key)
+		if !ok {
+			return "", false
+		}
+		return v.(string), true
+	}
+	values, err := store.backend.Load(key)
+	if err != nil {
+		return "", false
+	}
+	v, ok := values["grant"].(string)
+	return v, ok
+}
+
+func grantSave(local *cache.Cache, key, value string, expires time.Time) error {
+	ttl := time.Until(expires).Round(time.Second)
+	if ttl <= 0 {
+		return errGrantExpired
+	}
+	if store.backend == nil {
+		local.Set(key, value, ttl)
+		return nil
+	}
+	return store.backend.Save(key, "", map[string]interface{}{"grant": value}, ttl)
+}
+
+func grantDelete(local *cache.Cache, key string) {
+	if store.backend == nil {
+		local.Delete(key)
+		return
+	}
+	store.backend.Delete(key)
+}
+
+// oauthError answers a token request with an OAuth 2.0 error code
+func oauthError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
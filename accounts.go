@@ -0,0 +1,126 @@
+package beyond
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	accountsURL    = flag.String("service-accounts-url", "", "URL or file of service accounts config (eg. https://github.com/myorg/beyond-config/main/raw/accounts.json)")
+	accountsHeader = flag.String("service-accounts-header", "X-Api-Key", "request header that may carry a service account key (blank disables)")
+
+	accounts = concurrentMapAccount{m: map[string]*serviceAccount{}}
+)
+
+// serviceAccount is an API key, stored as its SHA-256, for a named principal
+type serviceAccount struct {
+	Name    string    `json:"name"`
+	KeyHash string    `json:"key_sha256"`
+	Expires time.Time `json:"expires"`
+	Zones   []string  `json:"zones"`
+
+	zones map[string]bool
+}
+
+type concurrentMapAccount struct {
+	sync.RWMutex
+	m map[string]*serviceAccount
+}
+
+func refreshAccounts() error {
+	if *accountsURL == "" {
+		return nil
+	}
+
+	body, err := configOpen(*accountsURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	list := []*serviceAccount{}
+	err = json.NewDecoder(body).Decode(&list)
+	if err != nil {
+		return err
+	}
+
+	m := map[string]*serviceAccount{}
+	for _, a := range list {
+		hash, err := hex.DecodeString(a.KeyHash)
+		if a.Name == "" || err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("invalid service account: %q", a.Name)
+		}
+		a.zones = map[string]bool{}
+		for _, z := range a.Zones {
+			a.zones[z] = true
+		}
+		m[strings.ToLower(a.KeyHash)] = a
+	}
+
+	accounts.Lock()
+	accounts.m = m
+	accounts.Unlock()
+	return nil
+}
+
+// configOpen reads a config from a URL, or from a local path without a scheme
+func configOpen(u string) (io.ReadCloser, error) {
+	if !strings.Contains(u, "://") {
+		return os.Open(u)
+	}
+	resp, err := httpACLGet(u)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// accountAuth returns the service account for a request's key, if any
+func accountAuth(r *http.Request) *serviceAccount {
+	accounts.RLock()
+	m := accounts.m
+	accounts.RUnlock()
+	if len(m) < 1 {
+		return nil
+	}
+
+	key := ""
+	if *accountsHeader != "" {
+		key = r.Header.Get(*accountsHeader)
+	}
+	if key == "" {
+		key = tokenFromRequest(r)
+	}
+	if key == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	a := m[hex.EncodeToString(sum[:])]
+	if a == nil {
+		return nil
+	}
+	if !a.Expires.IsZero() && time.Now().After(a.Expires) {
+		WithField("account", a.Name).Info("service account key expired")
+		return nil
+	}
+	return a
+}
+
+// accountKeyStrip removes the header, query parameter or credentials that
+// carried a service account key, so backends cannot replay it on other sites
+func accountKeyStrip(r *http.Request) {
+	if *accountsHeader != "" && r.Header.Get(*accountsHeader) != "" {
+		r.Header.Del(*accountsHeader)
+		return
+	}
+	accessTokenStrip(r)
+}
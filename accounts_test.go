@@ -0,0 +1,73 @@
+package beyond
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceAccounts(t *testing.T) {
+	prev := *accountsURL
+	defer func() {
+		*accountsURL = prev
+		accounts.m = map[string]*serviceAccount{}
+	}()
+	cwd, _ := os.Getwd()
+	*accountsURL = cwd + "/example/accounts.json"
+	assert.NoError(t, refreshAccounts())
+
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Nil(t, accountAuth(r))
+	r.Header.Set("Authorization", "Bearer svc-key-deploy")
+	assert.Equal(t, "ci-deploy@svc.myorg.net", accountAuth(r).Name)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("svc-key-deploy", "")
+	assert.Equal(t, "ci-deploy@svc.myorg.net", accountAuth(r).Name)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Api-Key", "svc-key-deploy")
+	assert.Equal(t, "ci-deploy@svc.myorg.net", accountAuth(r).Name)
+
+	r.Header.Set("Authorization", "Bearer backend-token")
+	accountKeyStrip(r)
+	assert.Equal(t, "", r.Header.Get("X-Api-Key"))
+	assert.Equal(t, "Bearer backend-token", r.Header.Get("Authorization"))
+
+	// keys are not passed on to backends
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/?access_token=svc-key-deploy&page=2", nil),
+		httptest.NewRequest("GET", "/", nil),
+	} {
+		if r.URL.RawQuery == "" {
+			r.SetBasicAuth("svc-key-deploy", "")
+		}
+		assert.NotNil(t, accountAuth(r))
+		accountKeyStrip(r)
+		assert.Nil(t, accountAuth(r))
+		assert.Equal(t, "", r.Header.Get("Authorization"))
+	}
+
+	r.Header.Set("X-Api-Key", "svc-key-old")
+	assert.Nil(t, accountAuth(r))
+	r.Header.Set("X-Api-Key", "svc-key-unknown")
+	assert.Nil(t, accountAuth(r))
+
+	// accounts are limited to their zones
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Api-Key", "svc-key-deploy")
+	request.Host = "github.com"
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"name": "bad", "key_sha256": "plaintext"}]`), 0600))
+	*accountsURL = path
+	assert.EqualError(t, refreshAccounts(), `invalid service account: "bad"`)
+	assert.Len(t, accounts.m, 2)
+}
@@ -3,7 +3,9 @@ package beyond
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"net/http"
+	"net/url"
 	"path"
 	"sync"
 )
@@ -20,6 +22,20 @@ var (
 	httpACL = &http.Client{}
 )
 
+// httpACLGet fetches a config, rejecting error responses so that an error
+// body never replaces a live config
+func httpACLGet(u string) (*http.Response, error) {
+	resp, err := httpACL.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected config response: %s", resp.Status)
+	}
+	return resp, nil
+}
+
 type concurrentMapMapBool struct {
 	sync.RWMutex
 	m map[string]map[string]bool
@@ -30,7 +46,7 @@ func refreshFence() error {
 		return nil
 	}
 
-	resp, err := httpACL.Get(*fenceURL)
+	resp, err := httpACLGet(*fenceURL)
 	if err != nil {
 		return err
 	}
@@ -40,14 +56,13 @@ func refreshFence() error {
 	if err != nil {
 		return err
 	}
-	for k, v := range d {
-		if _, ok := fence.m[k]; !ok {
-			fence.m[k] = map[string]bool{}
-		}
-		for _, v := range v {
-			fence.m[k][v] = true
-		}
+	m, err := aclSnapshot(d, userFold)
+	if err != nil {
+		return err
 	}
+	fence.Lock()
+	fence.m = m
+	fence.Unlock()
 	return nil
 }
 
@@ -56,7 +71,7 @@ func refreshSites() error {
 		return nil
 	}
 
-	resp, err := httpACL.Get(*sitesURL)
+	resp, err := httpACLGet(*sitesURL)
 	if err != nil {
 		return err
 	}
@@ -66,16 +81,24 @@ func refreshSites() error {
 	if err != nil {
 		return err
 	}
-	sites.Lock()
-	defer sites.Unlock()
-	for k, v := range d {
-		if _, ok := sites.m[k]; !ok {
-			sites.m[k] = map[string]bool{}
-		}
-		for _, v := range v {
-			sites.m[k][v] = true
+	m, err := aclSnapshot(d, nil)
+	if err != nil {
+		return err
+	}
+	for _, v := range m {
+		for x := range v {
+			u, err := url.Parse(x)
+			if err != nil {
+				return err
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid site URL: %q", x)
+			}
 		}
 	}
+	sites.Lock()
+	sites.m = m
+	sites.Unlock()
 	return nil
 }
 
@@ -84,14 +107,41 @@ func refreshAllowlist() error {
 		return nil
 	}
 
-	resp, err := httpACL.Get(*allowlistURL)
+	resp, err := httpACLGet(*allowlistURL)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	m := map[string]map[string]bool{}
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		return err
+	}
 	allowlist.Lock()
-	defer allowlist.Unlock()
-	return json.NewDecoder(resp.Body).Decode(&allowlist.m)
+	allowlist.m = m
+	allowlist.Unlock()
+	return nil
+}
+
+// aclSnapshot builds a complete replacement map from a decoded config,
+// folding keys with fold when it is set
+func aclSnapshot(d map[string][]string, fold func(string) string) (map[string]map[string]bool, error) {
+	m := map[string]map[string]bool{}
+	for k, v := range d {
+		if fold != nil {
+			k = fold(k)
+		}
+		if k == "" {
+			return nil, fmt.Errorf("empty key in config")
+		}
+		if m[k] == nil {
+			m[k] = map[string]bool{}
+		}
+		for _, v := range v {
+			m[k][v] = true
+		}
+	}
+	return m, nil
 }
 
 func allowlisted(r *http.Request) bool {
@@ -112,12 +162,39 @@ func allowlisted(r *http.Request) bool {
 	return allow
 }
 
-func deny(r *http.Request, user string) bool {
+// fencePrincipals lists the fence keys that may grant zones to a user
+func fencePrincipals(user string, groups []string) []string {
+	principals := []string{user}
+	for _, g := range groups {
+		principals = append(principals, "group:"+g)
+	}
+	return principals
+}
+
+func deny(r *http.Request, principals ...string) bool {
+	return denyZones(r, fenceZones(principals...))
+}
+
+// fenceZones is the union of the zones granted to principals
+func fenceZones(principals ...string) map[string]bool {
 	fence.RLock()
-	zones, ok := fence.m[user]
+	f := fence.m
 	fence.RUnlock()
 
-	if !ok || len(zones) < 1 {
+	// fence keys are folded like users, see refreshFence
+	zones := map[string]bool{}
+	for _, p := range principals {
+		for k := range f[userFold(p)] {
+			zones[k] = true
+		}
+	}
+	return zones
+}
+
+// denyZones reports whether the request's site is outside all of zones;
+// no zones means no restriction
+func denyZones(r *http.Request, zones map[string]bool) bool {
+	if len(zones) < 1 {
 		return false
 	}
 
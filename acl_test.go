@@ -58,3 +58,21 @@ func TestACL(t *testing.T) {
 	reqAllow, _ := http.NewRequest("GET", "https://github.com/test", nil)
 	assert.False(t, deny(reqAllow, "consultant@gmail.com"))
 }
+
+func TestACLGroups(t *testing.T) {
+	prev := fence.m
+	defer func() { fence.m = prev }()
+	fence.m = map[string]map[string]bool{
+		"vendor@gmail.com":  {"test": true},
+		"group:contractors": {"git": true},
+	}
+
+	reqGit, _ := http.NewRequest("GET", "https://github.com/test", nil)
+	reqTest, _ := http.NewRequest("GET", "https://httpbin.org/get", nil)
+
+	assert.True(t, deny(reqGit, fencePrincipals("vendor@gmail.com", nil)...))
+	assert.False(t, deny(reqGit, fencePrincipals("vendor@gmail.com", []string{"contractors"})...))
+	assert.False(t, deny(reqTest, fencePrincipals("vendor@gmail.com", []string{"contractors"})...))
+	assert.True(t, deny(reqTest, fencePrincipals("someone@gmail.com", []string{"contractors"})...))
+	assert.False(t, deny(reqTest, fencePrincipals("someone@gmail.com", []string{"staff"})...))
+}
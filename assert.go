@@ -0,0 +1,51 @@
+package beyond
+
+import (
+	"flag"
+	"net/http"
+	"time"
+
+	"gopkg.in/go-jose/go-jose.v2/jwt"
+)
+
+var (
+	assertionEnabled = flag.Bool("assertion", false, "add a JWT signed by the keys at /.well-known/jwks.json to proxied requests in the {header-prefix}-Assertion header")
+	assertionTTL     = flag.Duration("assertion-ttl", time.Minute, "lifetime of assertion JWTs")
+)
+
+// assertionClaims are the identity claims of an assertion JWT
+type assertionClaims struct {
+	Email    string   `json:"email"`
+	Groups   []string `json:"groups,omitempty"`
+	AuthTime int64    `json:"auth_time"`
+	TokenUse string   `json:"token_use"`
+}
+
+// assertionSet signs the identity of a request for its backend, with the
+// origin of the requested host as the audience
+func assertionSet(r *http.Request, user string, groups []string, authTime int64) {
+	if !*assertionEnabled {
+		return
+	}
+
+	token, err := assertionToken(user, groups, authTime, "https://"+r.Host)
+	if err != nil {
+		WithError(err).WithField("user", user).Error("assertion signing failed")
+		return
+	}
+	r.Header.Set(*headerPrefix+"-Assertion", token)
+}
+
+func assertionToken(user string, groups []string, authTime int64, audience string) (string, error) {
+	now := time.Now()
+	if authTime == 0 {
+		authTime = now.Unix()
+	}
+	return signJWT(jwt.Claims{
+		Issuer:   "https://" + *host,
+		Subject:  user,
+		Audience: jwt.Audience{audience},
+		Expiry:   jwt.NewNumericDate(now.Add(*assertionTTL)),
+		IssuedAt: jwt.NewNumericDate(now),
+	}, assertionClaims{Email: user, Groups: groups, AuthTime: authTime, TokenUse: "assertion"})
+}
@@ -0,0 +1,67 @@
+package beyond
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/go-jose/go-jose.v2/jwt"
+)
+
+func TestAssertion(t *testing.T) {
+	assert.NoError(t, signingSetup())
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(*headerPrefix + "-Assertion")))
+	}))
+	defer backend.Close()
+	backendHost := backend.URL[7:]
+
+	authTime := time.Now().Add(-time.Hour).Unix()
+	vals := map[string]interface{}{"user": "cloud@user.com", "groups": []string{"staff"}, "auth_time": authTime}
+	cookieValue, err := securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
+	assert.NoError(t, err)
+	assertionTest := func() *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Host = backendHost
+		request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookieValue})
+		request.Header.Set(*headerPrefix+"-Assertion", "spoofed")
+		w := httptest.NewRecorder()
+		testMux.ServeHTTP(w, request)
+		assert.Equal(t, 200, w.Result().StatusCode)
+		return w
+	}
+
+	// disabled by default, and inbound values are dropped
+	assert.Equal(t, "", assertionTest().Body.String())
+
+	*assertionEnabled = true
+	defer func() { *assertionEnabled = false }()
+	w := assertionTest()
+
+	extra := assertionClaims{}
+	claims, err := verifyJWT(w.Body.String(), jwt.Expected{Issuer: "https://" + *host, Audience: jwt.Audience{"https://" + backendHost}}, &extra)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "cloud@user.com", claims.Subject)
+	assert.Equal(t, []string{"staff"}, extra.Groups)
+	assert.Equal(t, authTime, extra.AuthTime)
+	assert.Equal(t, "assertion", extra.TokenUse)
+	assert.True(t, claims.Expiry.Time().Before(time.Now().Add(*assertionTTL+time.Second)))
+
+	// the audience binds it to one backend
+	_, err = verifyJWT(w.Body.String(), jwt.Expected{Audience: jwt.Audience{"https://other.myorg.net"}})
+	assert.Equal(t, jwt.ErrInvalidAudience, err)
+
+	// and a backend cannot pass it off as a federation token
+	request := httptest.NewRequest("GET", "/federate/verify?aud="+url.QueryEscape("https://"+backendHost)+"&token="+w.Body.String(), nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "not a federation token")
+}
@@ -0,0 +1,153 @@
+package beyond
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	"golang.org/x/oauth2"
+)
+
+var (
+	cliLogin    = flag.Bool("cli-login", false, "enable /token, which issues bearer tokens to CLIs through a loopback redirect_uri")
+	cliTokenTTL = flag.Duration("cli-token-ttl", time.Hour, "lifetime of bearer tokens issued by /token")
+
+	cliMu    sync.Mutex
+	cliCodes = cache.New(time.Minute, 10*time.Minute)
+)
+
+// cliCodeTTL is how long a /token authorization code may be exchanged
+const cliCodeTTL = time.Minute
+
+// cliGrant is the identity behind a /token authorization code
+type cliGrant struct {
+	RedirectURI string
+	Challenge   string
+	Expires     time.Time
+
+	accessGrant
+}
+
+// cliRedirectAllowed accepts only loopback redirect_uris (RFC 8252 section 7.3)
+func cliRedirectAllowed(redirect string) bool {
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme != "http" || u.User != nil {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleToken sends a signed-in user back to a CLI's loopback redirect_uri
+// with a code (GET), which the CLI exchanges for a bearer token (POST)
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	setCacheControl(w)
+	switch r.Method {
+	case http.MethodGet:
+		cliAuthorize(w, r)
+	case http.MethodPost:
+		cliExchange(w, r)
+	default:
+		errorHandler(w, 405, "")
+	}
+}
+
+func cliAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect := q.Get("redirect_uri")
+	if !cliRedirectAllowed(redirect) {
+		errorHandler(w, 400, "Invalid Redirect")
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) < 43 {
+		errorHandler(w, 400, "PKCE Required")
+		return
+	}
+
+	session, err := store.Get(r, *cookieName)
+	if err != nil {
+		session = store.New(*cookieName)
+	}
+	user, _ := session.Values["user"].(string)
+	if user == "" || !sessionActive(w, session) {
+		login(w, r)
+		return
+	}
+
+	code, err := randhex32()
+	if err != nil {
+		errorHandler(w, 500, err.Error())
+		return
+	}
+	grant, err := json.Marshal(&cliGrant{
+		RedirectURI: redirect,
+		Challenge:   q.Get("code_challenge"),
+		Expires:     time.Now().Add(cliCodeTTL),
+		accessGrant: accessGrantFrom(session),
+	})
+	if err == nil {
+		err = grantSave(cliCodes, "cli:"+code, string(grant), time.Now().Add(cliCodeTTL))
+	}
+	if err != nil {
+		errorHandler(w, 500, err.Error())
+		return
+	}
+
+	u, _ := url.Parse(redirect)
+	v := u.Query()
+	v.Set("code", code)
+	if state := q.Get("state"); state != "" {
+		v.Set("state", state)
+	}
+	u.RawQuery = v.Encode()
+	WithField("user", user).Info("cli login")
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func cliExchange(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "authorization_code" {
+		oauthError(w, "unsupported_grant_type")
+		return
+	}
+	// codes are single-use, so take the code and delete it together
+	code := r.FormValue("code")
+	cliMu.Lock()
+	v, ok := grantLoad(cliCodes, "cli:"+code)
+	if ok {
+		grantDelete(cliCodes, "cli:"+code)
+	}
+	cliMu.Unlock()
+	grant := &cliGrant{}
+	if !ok || json.Unmarshal([]byte(v), grant) != nil || time.Now().After(grant.Expires) {
+		oauthError(w, "invalid_grant")
+		return
+	}
+	if grant.RedirectURI != r.FormValue("redirect_uri") || grant.Challenge != oauth2.S256ChallengeFromVerifier(r.FormValue("code_verifier")) {
+		oauthError(w, "invalid_grant")
+		return
+	}
+
+	token, ttl, err := accessToken(grant.accessGrant, *cliTokenTTL)
+	if err == errSessionNotFound {
+		oauthError(w, "invalid_grant")
+		return
+	}
+	if err != nil {
+		errorHandler(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+	})
+}
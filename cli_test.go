@@ -0,0 +1,179 @@
+package beyond
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestCLILogin(t *testing.T) {
+	assert.NoError(t, signingSetup())
+	*cliLogin = true
+	defer func() { *cliLogin = false }()
+	mux := NewMux()
+
+	verifier := oauth2.GenerateVerifier()
+	redirect := "http://127.0.0.1:8910/callback"
+	authorize := func(q url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/token?"+q.Encode(), nil)
+		request.Host = *host
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, request)
+		return w
+	}
+	q := url.Values{
+		"redirect_uri":          {redirect},
+		"state":                 {"xyz"},
+		"code_challenge":        {oauth2.S256ChallengeFromVerifier(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	w := authorize(q, nil)
+	assert.Equal(t, *fouroOneCode, w.Code)
+
+	cookie := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com", "groups": []string{"staff"}})
+	bad := url.Values{"redirect_uri": {"http://evil.com/callback"}, "code_challenge": q["code_challenge"], "code_challenge_method": {"S256"}}
+	w = authorize(bad, cookie)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid Redirect")
+	w = authorize(url.Values{"redirect_uri": {redirect}}, cookie)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "PKCE Required")
+
+	w = authorize(q, cookie)
+	assert.Equal(t, 302, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8910", location.Host)
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirect}, "code_verifier": {"wrong"}}
+	w = deviceTestPost(mux, "/token", exchange, nil)
+	assert.JSONEq(t, `{"error": "invalid_grant"}`, w.Body.String())
+
+	w = authorize(q, cookie)
+	location, _ = url.Parse(w.Header().Get("Location"))
+	exchange.Set("code", location.Query().Get("code"))
+	exchange.Set("code_verifier", verifier)
+	w = deviceTestPost(mux, "/token", exchange, nil)
+	assert.Equal(t, 200, w.Code)
+	token := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&token))
+	assert.Equal(t, "Bearer", token["token_type"])
+	assert.Equal(t, 3600.0, token["expires_in"])
+
+	w = deviceTestPost(mux, "/token", exchange, nil)
+	assert.JSONEq(t, `{"error": "invalid_grant"}`, w.Body.String())
+
+	// the token is accepted like a session, and not passed on
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Beyond-User") + r.Header.Get("Authorization")))
+	}))
+	defer backend.Close()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = backend.URL[7:]
+	request.Header.Set("Authorization", "Bearer "+token["access_token"].(string))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, request)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "cloud@user.com", w.Body.String())
+}
+
+// cliTestCode runs the /token authorization for the session cookie and
+// returns the exchange for its code
+func cliTestCode(t *testing.T, mux http.Handler, cookie *http.Cookie) url.Values {
+	verifier := oauth2.GenerateVerifier()
+	redirect := "http://127.0.0.1:8910/callback"
+	q := url.Values{
+		"redirect_uri":          {redirect},
+		"code_challenge":        {oauth2.S256ChallengeFromVerifier(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	request := httptest.NewRequest("GET", "/token?"+q.Encode(), nil)
+	request.Host = *host
+	request.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, request)
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	return url.Values{"grant_type": {"authorization_code"}, "code": {location.Query().Get("code")}, "redirect_uri": {redirect}, "code_verifier": {verifier}}
+}
+
+// cliTestToken runs the /token login for the session cookie
+func cliTestToken(t *testing.T, mux http.Handler, cookie *http.Cookie) map[string]interface{} {
+	w := deviceTestPost(mux, "/token", cliTestCode(t, mux, cookie), nil)
+	token := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&token))
+	return token
+}
+
+func TestCLISession(t *testing.T) {
+	assert.NoError(t, signingSetup())
+	*cliLogin = true
+	store.backend = newMemorySessions()
+	defer func() {
+		*cliLogin, *sessionMaxAge = false, 0
+		store.backend = nil
+	}()
+	mux := NewMux()
+	bearer := func(token map[string]interface{}) string {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("Authorization", "Bearer "+token["access_token"].(string))
+		user, _, _ := accessTokenUser(request)
+		return user
+	}
+
+	// codes live in the shared backend, and are redeemed once
+	cookie := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com"})
+	exchange := cliTestCode(t, mux, cookie)
+	assert.Zero(t, cliCodes.ItemCount())
+	var wg sync.WaitGroup
+	var issued int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if deviceTestPost(mux, "/token", exchange, nil).Code == 200 {
+				atomic.AddInt32(&issued, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), issued)
+
+	// tokens end with the session they were issued for
+	token := cliTestToken(t, mux, cookie)
+	assert.Equal(t, "cloud@user.com", bearer(token))
+	assert.NoError(t, store.backend.Revoke("cloud@user.com"))
+	assert.Equal(t, "", bearer(token))
+
+	// and do not outlive -session-lifetime
+	*sessionMaxAge = time.Hour
+	cookie = sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com", "login_time": time.Now().Add(-50 * time.Minute).Unix()})
+	token = cliTestToken(t, mux, cookie)
+	assert.InDelta(t, 600, token["expires_in"], 2)
+	assert.Equal(t, "cloud@user.com", bearer(token))
+}
+
+func TestCLIRedirectAllowed(t *testing.T) {
+	assert.True(t, cliRedirectAllowed("http://127.0.0.1:8910/callback"))
+	assert.True(t, cliRedirectAllowed("http://[::1]:8910/"))
+	assert.True(t, cliRedirectAllowed("http://localhost/callback"))
+	assert.False(t, cliRedirectAllowed("https://127.0.0.1/callback"))
+	assert.False(t, cliRedirectAllowed("http://user@127.0.0.1/"))
+	assert.False(t, cliRedirectAllowed("http://127.0.0.1.evil.com/"))
+	assert.False(t, cliRedirectAllowed("http://myorg.net/"))
+}
@@ -0,0 +1,261 @@
+// Command beyond logs in to a beyond proxy from the command line and prints
+// a bearer token for curl and scripts:
+//
+//	curl -H "Authorization: Bearer $(beyond -beyond-host beyond.myorg.net token)" https://app.myorg.net/
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	beyondHost = flag.String("beyond-host", os.Getenv("BEYOND_HOST"), "hostname of beyond (default $BEYOND_HOST)")
+	cacheDir   = flag.String("cache-dir", "", "directory of cached tokens (blank uses the user cache directory)")
+	device     = flag.Bool("device", false, "log in by approving a code on another device instead of opening a browser here")
+	timeout    = flag.Duration("timeout", 5*time.Minute, "max time to wait for the login to finish")
+)
+
+// cachedToken is a bearer token saved between runs
+type cachedToken struct {
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// tokenResponse is an OAuth 2.0 token endpoint response
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	Error       string `json:"error"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] login|token|logout\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *beyondHost == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "login":
+		_, err = login()
+	case "token":
+		var token *cachedToken
+		token, err = cacheLoad()
+		if err != nil || time.Until(token.Expiry) < time.Minute {
+			token, err = login()
+		}
+		if err == nil {
+			fmt.Println(token.AccessToken)
+		}
+	case "logout":
+		err = os.Remove(cachePath())
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "beyond:", err)
+		os.Exit(1)
+	}
+}
+
+func login() (*cachedToken, error) {
+	var (
+		resp *tokenResponse
+		err  error
+	)
+	if *device {
+		resp, err = loginDevice()
+	} else {
+		resp, err = loginBrowser()
+	}
+	if err != nil {
+		return nil, err
+	}
+	token := &cachedToken{AccessToken: resp.AccessToken, Expiry: time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)}
+	return token, cacheSave(token)
+}
+
+// loginBrowser receives a code on a loopback redirect_uri and exchanges it
+// with PKCE at /token
+func loginBrowser() (*tokenResponse, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	redirect := "http://" + ln.Addr().String() + "/callback"
+	verifier := oauth2.GenerateVerifier()
+	state := randhex()
+
+	codes := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" || r.URL.Query().Get("state") != state {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Logged in to beyond. You can close this window.")
+		select {
+		case codes <- r.URL.Query().Get("code"):
+		default:
+		}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	authURL := "https://" + *beyondHost + "/token?" + url.Values{
+		"redirect_uri":          {redirect},
+		"state":                 {state},
+		"code_challenge":        {oauth2.S256ChallengeFromVerifier(verifier)},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+	fmt.Fprintln(os.Stderr, "Opening your browser to log in. If it does not open, visit:")
+	fmt.Fprintln(os.Stderr, authURL)
+	openBrowser(authURL)
+
+	select {
+	case code := <-codes:
+		return tokenRequest("/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {redirect},
+			"code_verifier": {verifier},
+		})
+	case <-time.After(*timeout):
+		return nil, errors.New("timed out waiting for the browser login")
+	}
+}
+
+// loginDevice polls /device/token while the user approves the code elsewhere
+func loginDevice() (*tokenResponse, error) {
+	resp, err := http.PostForm("https://"+*beyondHost+"/device/code", url.Values{"client_id": {"beyond"}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	code := struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURI string `json:"verification_uri"`
+		Interval        int    `json:"interval"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&code)
+	if err != nil {
+		return nil, err
+	}
+	if code.DeviceCode == "" {
+		return nil, fmt.Errorf("device login unavailable: %s", resp.Status)
+	}
+	fmt.Fprintf(os.Stderr, "Visit %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(*timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		token, err := tokenRequest("/device/token", url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {code.DeviceCode},
+		})
+		switch {
+		case token != nil && token.Error == "authorization_pending":
+		case token != nil && token.Error == "slow_down":
+			interval += 5 * time.Second
+		default:
+			return token, err
+		}
+	}
+	return nil, errors.New("timed out waiting for the device login")
+}
+
+func tokenRequest(path string, form url.Values) (*tokenResponse, error) {
+	resp, err := http.PostForm("https://"+*beyondHost+path, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	token := &tokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(token)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	if token.Error == "authorization_pending" || token.Error == "slow_down" {
+		return token, nil
+	}
+	if token.Error != "" || token.AccessToken == "" {
+		return nil, fmt.Errorf("%s: %s %s", path, resp.Status, token.Error)
+	}
+	return token, nil
+}
+
+func openBrowser(u string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	cmd.Start()
+}
+
+func cachePath() string {
+	dir := *cacheDir
+	if dir == "" {
+		dir, _ = os.UserCacheDir()
+		dir = filepath.Join(dir, "beyond")
+	}
+	return filepath.Join(dir, strings.ReplaceAll(*beyondHost, string(filepath.Separator), "_")+".json")
+}
+
+func cacheLoad() (*cachedToken, error) {
+	b, err := os.ReadFile(cachePath())
+	if err != nil {
+		return nil, err
+	}
+	token := &cachedToken{}
+	return token, json.Unmarshal(b, token)
+}
+
+func cacheSave(token *cachedToken) error {
+	path := cachePath()
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+func randhex() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -10,7 +10,11 @@ import (
 )
 
 var (
-	bind = flag.String("http", ":80", "listen address")
+	bind = flag.String("http", ":80", "listen address (blank disables)")
+
+	tlsBind = flag.String("https", "", "TLS listen address (blank disables)")
+	tlsCert = flag.String("tls-cert-file", "", "TLS server certificate chain PEM")
+	tlsKey  = flag.String("tls-key-file", "", "TLS server private key PEM")
 
 	srvReadTimeout  = flag.Duration("server-read-timeout", 1*time.Minute, "max duration for reading the entire request, including the body")
 	srvWriteTimeout = flag.Duration("server-write-timeout", 2*time.Minute, "max duration before timing out writes of the response")
@@ -23,15 +27,36 @@ func main() {
 	if err := beyond.Setup(); err != nil {
 		log.Fatal(err)
 	}
+	if *bind == "" && *tlsBind == "" {
+		log.Fatal("no listen address: set -http or -https")
+	}
+
+	mux := beyond.NewMux()
+	errc := make(chan error)
+	if *bind != "" {
+		srv := server(*bind, mux)
+		go func() { errc <- srv.ListenAndServe() }()
+	}
+	if *tlsBind != "" {
+		tlsConfig, err := beyond.ServerTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv := server(*tlsBind, mux)
+		srv.TLSConfig = tlsConfig
+		go func() { errc <- srv.ListenAndServeTLS(*tlsCert, *tlsKey) }()
+	}
+	log.Fatal(<-errc)
+}
 
-	srv := &http.Server{
-		Addr:    *bind,
-		Handler: beyond.NewMux(),
+func server(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:    addr,
+		Handler: handler,
 
 		// https://blog.cloudflare.com/exposing-go-on-the-internet/
 		ReadTimeout:  *srvReadTimeout,
 		WriteTimeout: *srvWriteTimeout,
 		IdleTimeout:  *srvIdleTimeout,
 	}
-	log.Fatal(srv.ListenAndServe())
 }
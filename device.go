@@ -0,0 +1,294 @@
+package beyond
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+const (
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// RFC 8628 recommends consonants only, so codes spell no words
+	deviceCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+var (
+	deviceFlow     = flag.Bool("device-flow", false, "enable the OAuth 2.0 device authorization grant at /device for CLI users")
+	deviceCodeTTL  = flag.Duration("device-code-ttl", 10*time.Minute, "lifetime of device flow user codes")
+	deviceInterval = flag.Duration("device-interval", 5*time.Second, "minimum polling interval of device flow clients")
+	deviceTokenTTL = flag.Duration("device-token-ttl", time.Hour, "lifetime of bearer tokens issued by the device flow")
+
+	deviceMu    sync.Mutex
+	deviceCodes = cache.New(10*time.Minute, 10*time.Minute)
+
+	deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta charset="utf-8" /><meta name="viewport" content="width=device-width, initial-scale=1" />
+		<title>Device Login</title>
+		<style type="text/css">body{background-color:#21232a;color:{{.color}};font-family:"Open Sans",Arial,sans-serif;text-align:center;padding-top:10%}input{font-size:1.5em;text-align:center;letter-spacing:.1em;margin:1em}button{margin:.5em;padding:.75em 2em;color:#fff;background:none;border:1px solid #707070}button:hover{border-color:{{.color}}}p{color:silver}</style>
+	</head>
+	<body>
+		<h1>Device Login</h1>
+		{{if .message}}<p>{{.message}}</p>
+		{{else}}<form method="post" action="/device">
+			<p>Signed in as {{.user}}. Only approve a code you requested yourself.</p>
+			<input name="user_code" value="{{.code}}" placeholder="XXXX-XXXX" autocomplete="off" autofocus /><br />
+			<input type="hidden" name="csrf" value="{{.csrf}}" />
+			<button name="action" value="approve">Approve</button><button name="action" value="deny">Deny</button>
+		</form>
+		{{end}}
+	</body>
+</html>`))
+)
+
+// deviceGrant is a pending or decided device authorization
+type deviceGrant struct {
+	UserCode string
+	Interval time.Duration
+	Polled   time.Time
+	Expires  time.Time
+
+	accessGrant
+	Denied bool
+}
+
+// handleDeviceCode starts a device authorization (RFC 8628 section 3.1)
+func handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	setCacheControl(w)
+	if r.Method != http.MethodPost {
+		errorHandler(w, 405, "")
+		return
+	}
+
+	deviceCode, err := randhex32()
+	if err != nil {
+		errorHandler(w, 500, err.Error())
+		return
+	}
+	userCode, err := deviceUserCode()
+	if err != nil {
+		errorHandler(w, 500, err.Error())
+		return
+	}
+	grant := &deviceGrant{UserCode: userCode, Interval: *deviceInterval, Expires: time.Now().Add(*deviceCodeTTL)}
+	err = deviceGrantSave(deviceCode, grant)
+	if err == nil {
+		err = grantSave(deviceCodes, "user:"+userCode, deviceCode, grant.Expires)
+	}
+	if err != nil {
+		errorHandler(w, 500, err.Error())
+		return
+	}
+
+	verify := "https://" + *host + "/device"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verify,
+		"verification_uri_complete": verify + "?user_code=" + url.QueryEscape(userCode),
+		"expires_in":                int(deviceCodeTTL.Seconds()),
+		"interval":                  int(deviceInterval.Seconds()),
+	})
+}
+
+func deviceUserCode() (string, error) {
+	b := make([]byte, 8)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(deviceCodeChars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = deviceCodeChars[n.Int64()]
+	}
+	return string(b[:4]) + "-" + string(b[4:]), nil
+}
+
+// deviceUserCodeNormalize accepts user codes typed in any case, with or
+// without the dash
+func deviceUserCodeNormalize(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// handleDevice asks a signed-in user to approve or deny a user code
+func handleDevice(w http.ResponseWriter, r *http.Request) {
+	setCacheControl(w)
+	session, err := store.Get(r, *cookieName)
+	if err != nil {
+		session = store.New(*cookieName)
+	}
+	user, _ := session.Values["user"].(string)
+	if user == "" || !sessionActive(w, session) {
+		login(w, r)
+		return
+	}
+
+	data := map[string]interface{}{
+		"color": *errorColor,
+		"user":  user,
+		"code":  deviceUserCodeNormalize(r.FormValue("user_code")),
+	}
+	switch r.Method {
+	case http.MethodGet:
+		// the form carries a per-session token, so other sites can't post it
+		csrf, _ := session.Values["csrf"].(string)
+		if csrf == "" {
+			csrf, err = randhex32()
+			if err != nil {
+				errorHandler(w, 500, err.Error())
+				return
+			}
+			session.Values["csrf"] = csrf
+			session.Save(w)
+		}
+		data["csrf"] = csrf
+	case http.MethodPost:
+		if !sessionSameOrigin(r) {
+			errorHandler(w, 403, "Invalid Origin")
+			return
+		}
+		if csrf, _ := session.Values["csrf"].(string); csrf == "" || subtle.ConstantTimeCompare([]byte(csrf), []byte(r.FormValue("csrf"))) != 1 {
+			errorHandler(w, 403, "Invalid Form")
+			return
+		}
+		data["message"] = deviceDecide(data["code"].(string), r.FormValue("action") == "approve", accessGrantFrom(session))
+	default:
+		errorHandler(w, 405, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	err = deviceTemplate.Execute(w, data)
+	if err != nil {
+		Error(err)
+	}
+}
+
+func deviceDecide(userCode string, approve bool, approval accessGrant) string {
+	deviceCode, ok := grantLoad(deviceCodes, "user:"+userCode)
+	if !ok {
+		return "This code is invalid or has expired. Start again from your device."
+	}
+	grantDelete(deviceCodes, "user:"+userCode)
+
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	grant, ok := deviceGrantLoad(deviceCode)
+	if !ok {
+		return "This code is invalid or has expired. Start again from your device."
+	}
+	if approve {
+		grant.accessGrant = approval
+	} else {
+		grant.Denied = true
+	}
+	err := deviceGrantSave(deviceCode, grant)
+	if err != nil {
+		WithError(err).WithField("code", userCode).Error("device grant not saved")
+		return "This code could not be saved. Start again from your device."
+	}
+	if !approve {
+		WithFields(map[string]interface{}{"user": approval.User, "code": userCode}).Info("device login denied")
+		return "Denied. You can close this window."
+	}
+	WithFields(map[string]interface{}{"user": approval.User, "code": userCode}).Info("device login approved")
+	return "Approved. You can close this window and return to your device."
+}
+
+// handleDeviceToken answers device flow polling (RFC 8628 section 3.4)
+func handleDeviceToken(w http.ResponseWriter, r *http.Request) {
+	setCacheControl(w)
+	if r.Method != http.MethodPost {
+		errorHandler(w, 405, "")
+		return
+	}
+	if r.FormValue("grant_type") != deviceGrantType {
+		oauthError(w, "unsupported_grant_type")
+		return
+	}
+
+	deviceCode := r.FormValue("device_code")
+	deviceMu.Lock()
+	grant, ok := deviceGrantLoad(deviceCode)
+	if !ok {
+		deviceMu.Unlock()
+		oauthError(w, "expired_token")
+		return
+	}
+	now := time.Now()
+	switch {
+	case grant.Denied:
+		grantDelete(deviceCodes, "device:"+deviceCode)
+		deviceMu.Unlock()
+		oauthError(w, "access_denied")
+		return
+	case grant.User == "" && now.Sub(grant.Polled) < grant.Interval:
+		grant.Interval += 5 * time.Second
+		grant.Polled = now
+		deviceGrantSave(deviceCode, grant)
+		deviceMu.Unlock()
+		oauthError(w, "slow_down")
+		return
+	case grant.User == "":
+		grant.Polled = now
+		deviceGrantSave(deviceCode, grant)
+		deviceMu.Unlock()
+		oauthError(w, "authorization_pending")
+		return
+	}
+	grantDelete(deviceCodes, "device:"+deviceCode)
+	deviceMu.Unlock()
+
+	token, ttl, err := accessToken(grant.accessGrant, *deviceTokenTTL)
+	if err == errSessionNotFound {
+		oauthError(w, "access_denied")
+		return
+	}
+	if err != nil {
+		errorHandler(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+	})
+}
+
+// deviceGrantLoad returns the unexpired grant of a device code
+func deviceGrantLoad(deviceCode string) (*deviceGrant, bool) {
+	v, ok := grantLoad(deviceCodes, "device:"+deviceCode)
+	if !ok {
+		return nil, false
+	}
+	grant := &deviceGrant{}
+	if json.Unmarshal([]byte(v), grant) != nil || time.Now().After(grant.Expires) {
+		return nil, false
+	}
+	return grant, true
+}
+
+func deviceGrantSave(deviceCode string, grant *deviceGrant) error {
+	b, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+	return grantSave(deviceCodes, "device:"+deviceCode, string(b), grant.Expires)
+}
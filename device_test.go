@@ -0,0 +1,209 @@
+package beyond
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func deviceTestPost(mux http.Handler, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	request.Host = *host
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, request)
+	return w
+}
+
+// deviceTestDecide approves or denies a user code from the /device form
+func deviceTestDecide(t *testing.T, mux http.Handler, cookie *http.Cookie, userCode, action string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", "/device", nil)
+	request.Host = *host
+	request.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, request)
+	if cookies := w.Result().Cookies(); len(cookies) > 0 {
+		cookie = cookies[len(cookies)-1]
+	}
+	csrf := regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`).FindStringSubmatch(w.Body.String())
+	assert.Len(t, csrf, 2)
+
+	form := url.Values{"user_code": {userCode}, "action": {action}, "csrf": {csrf[1]}}
+	request = httptest.NewRequest("POST", "/device", strings.NewReader(form.Encode()))
+	request.Host = *host
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Origin", "https://"+*host)
+	request.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, request)
+	return w
+}
+
+func TestDeviceFlow(t *testing.T) {
+	assert.NoError(t, signingSetup())
+	*deviceFlow = true
+	defer func() { *deviceFlow = false }()
+	mux := NewMux()
+
+	w := deviceTestPost(mux, "/device/code", url.Values{"client_id": {"cli"}}, nil)
+	assert.Equal(t, 200, w.Code)
+	code := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&code))
+	userCode := code["user_code"].(string)
+	assert.Regexp(t, "^[B-Z]{4}-[B-Z]{4}$", userCode)
+	assert.Equal(t, "https://"+*host+"/device", code["verification_uri"])
+	assert.Equal(t, 5.0, code["interval"])
+
+	poll := url.Values{"grant_type": {deviceGrantType}, "device_code": {code["device_code"].(string)}}
+	w = deviceTestPost(mux, "/device/token", poll, nil)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error": "authorization_pending"}`, w.Body.String())
+	w = deviceTestPost(mux, "/device/token", poll, nil)
+	assert.JSONEq(t, `{"error": "slow_down"}`, w.Body.String())
+
+	// the user signs in and approves
+	request := httptest.NewRequest("GET", "/device?user_code="+userCode, nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, request)
+	assert.Equal(t, *fouroOneCode, w.Code)
+
+	cookie := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com", "groups": []string{"staff"}})
+	request.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, request)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `value="`+userCode+`"`)
+
+	typed := strings.ToLower(strings.Replace(userCode, "-", "", 1))
+	w = deviceTestDecide(t, mux, cookie, typed, "approve")
+	assert.Contains(t, w.Body.String(), "Approved.")
+	w = deviceTestDecide(t, mux, cookie, userCode, "approve")
+	assert.Contains(t, w.Body.String(), "invalid or has expired")
+
+	w = deviceTestPost(mux, "/device/token", poll, nil)
+	assert.Equal(t, 200, w.Code)
+	token := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&token))
+	assert.Equal(t, "Bearer", token["token_type"])
+	w = deviceTestPost(mux, "/device/token", poll, nil)
+	assert.JSONEq(t, `{"error": "expired_token"}`, w.Body.String())
+
+	// the token is accepted like a session, and not passed on
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Beyond-User") + r.Header.Get("Authorization")))
+	}))
+	defer backend.Close()
+	request = httptest.NewRequest("GET", "/", nil)
+	request.Host = backend.URL[7:]
+	request.Header.Set("Authorization", "Bearer "+token["access_token"].(string))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, request)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "cloud@user.com", w.Body.String())
+
+	// other beyond JWTs are not
+	federated, err := federateToken("cloud@user.com", nil, "https://"+*host)
+	assert.NoError(t, err)
+	request = httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "Bearer "+federated)
+	user, _, _ := accessTokenUser(request)
+	assert.Equal(t, "", user)
+}
+
+func TestDeviceSessionStore(t *testing.T) {
+	assert.NoError(t, signingSetup())
+	*deviceFlow = true
+	store.backend = newMemorySessions()
+	defer func() {
+		*deviceFlow = false
+		store.backend = nil
+	}()
+	mux := NewMux()
+
+	// codes live in the shared backend, not in this instance
+	w := deviceTestPost(mux, "/device/code", nil, nil)
+	code := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&code))
+	assert.Zero(t, deviceCodes.ItemCount())
+	cookie := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com"})
+	w = deviceTestDecide(t, mux, cookie, code["user_code"].(string), "approve")
+	assert.Contains(t, w.Body.String(), "Approved.")
+
+	w = deviceTestPost(mux, "/device/token", url.Values{"grant_type": {deviceGrantType}, "device_code": {code["device_code"].(string)}}, nil)
+	assert.Equal(t, 200, w.Code)
+	token := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&token))
+	assert.Equal(t, 3600.0, token["expires_in"])
+
+	// and the token ends with the approving session
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "Bearer "+token["access_token"].(string))
+	user, _, _ := accessTokenUser(request)
+	assert.Equal(t, "cloud@user.com", user)
+	assert.NoError(t, store.backend.Revoke("cloud@user.com"))
+	user, _, _ = accessTokenUser(request)
+	assert.Equal(t, "", user)
+}
+
+func TestDeviceDenied(t *testing.T) {
+	*deviceFlow = true
+	defer func() { *deviceFlow = false }()
+	mux := NewMux()
+
+	w := deviceTestPost(mux, "/device/code", nil, nil)
+	code := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&code))
+	cookie := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com"})
+	w = deviceTestDecide(t, mux, cookie, code["user_code"].(string), "deny")
+	assert.Contains(t, w.Body.String(), "Denied.")
+
+	w = deviceTestPost(mux, "/device/token", url.Values{"grant_type": {deviceGrantType}, "device_code": {code["device_code"].(string)}}, nil)
+	assert.JSONEq(t, `{"error": "access_denied"}`, w.Body.String())
+	w = deviceTestPost(mux, "/device/token", url.Values{"grant_type": {"password"}}, nil)
+	assert.JSONEq(t, `{"error": "unsupported_grant_type"}`, w.Body.String())
+}
+
+func TestDeviceCSRF(t *testing.T) {
+	*deviceFlow = true
+	defer func() { *deviceFlow = false }()
+	mux := NewMux()
+
+	w := deviceTestPost(mux, "/device/code", nil, nil)
+	code := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&code))
+	cookie := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com", "csrf": "abc123"})
+	decide := func(form url.Values, header, value string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/device", strings.NewReader(form.Encode()))
+		request.Host = *host
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			request.Header.Set(header, value)
+		}
+		request.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, request)
+		return w
+	}
+
+	// cross-site posts are refused, with or without Origin
+	form := url.Values{"user_code": {code["user_code"].(string)}, "action": {"approve"}, "csrf": {"abc123"}}
+	assert.Equal(t, 403, decide(form, "", "").Code)
+	assert.Equal(t, 403, decide(form, "Origin", "https://evil.example.com").Code)
+	assert.Equal(t, 403, decide(form, "Sec-Fetch-Site", "cross-site").Code)
+	forged := url.Values{"user_code": form["user_code"], "action": {"approve"}, "csrf": {"guess"}}
+	assert.Equal(t, 403, decide(forged, "Origin", "https://"+*host).Code)
+
+	w = decide(form, "Sec-Fetch-Site", "same-origin")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "Approved.")
+}
@@ -2,27 +2,36 @@ package beyond
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/securecookie"
+	"gopkg.in/go-jose/go-jose.v2/jwt"
 )
 
 var (
 	federateAccessKey = flag.String("federate-access", "", "shared secret, 64 chars, enables federation")
 	federateSecretKey = flag.String("federate-secret", "", "internal secret, 64 chars")
+	federateJWT       = flag.Bool("federate-jwt", false, "issue federation tokens as JWTs signed by the keys at /.well-known/jwks.json")
+	federateTTL       = flag.Duration("federate-ttl", 5*time.Minute, "lifetime of federation JWTs")
 
 	federateAccessCodec []securecookie.Codec
 	federateSecretCodec []securecookie.Codec
 )
 
 func federateSetup() error {
+	if *federateSecretKey != "" {
+		federateSecretCodec = securecookie.CodecsFromPairs([]byte(*federateSecretKey)[0:31], []byte(*federateSecretKey)[32:64])
+	}
 	if *federateAccessKey == "" {
 		return nil
 	}
 
 	federateAccessCodec = securecookie.CodecsFromPairs([]byte(*federateAccessKey)[0:31], []byte(*federateAccessKey)[32:64])
-	federateSecretCodec = securecookie.CodecsFromPairs([]byte(*federateSecretKey)[0:31], []byte(*federateSecretKey)[32:64])
 	return nil
 }
 
@@ -31,7 +40,7 @@ func federate(w http.ResponseWriter, r *http.Request) {
 
 	// authenticate relying party
 	next := r.URL.Query().Get("next")
-	err := securecookie.DecodeMulti("next", next, &next, federateAccessCodec...)
+	party, err := federatePartyAuth(r.URL.Query().Get("rp"), &next)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
@@ -43,15 +52,31 @@ func federate(w http.ResponseWriter, r *http.Request) {
 		session = store.New(*cookieName)
 	}
 	user, _ := session.Values["user"].(string)
+	groups, _ := session.Values["groups"].([]string)
 
 	// 401
-	if user == "" {
+	if user == "" || !sessionActive(w, session) {
 		login(w, r)
 		return
 	}
 
+	// the user must be able to reach the relying party
+	if !federateAllowed(party, next, user, groups) {
+		errorHandler(w, 403, "Access Denied")
+		return
+	}
+
 	// issue token
-	token, err := securecookie.EncodeMulti("user", user, federateSecretCodec...)
+	var token string
+	if *federateJWT {
+		audience := federateAudience(next)
+		if party != nil {
+			audience = party.ID
+		}
+		token, err = federateToken(user, groups, audience)
+	} else {
+		token, err = securecookie.EncodeMulti("user", user, federateSecretCodec...)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -61,9 +86,61 @@ func federate(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, next+token, http.StatusFound)
 }
 
+// federateClaims are the identity claims of a federation JWT
+type federateClaims struct {
+	Email    string   `json:"email"`
+	Groups   []string `json:"groups,omitempty"`
+	TokenUse string   `json:"token_use"`
+}
+
+// federateAudience is the relying party origin of a next URL
+func federateAudience(next string) string {
+	u, err := url.Parse(next)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func federateToken(user string, groups []string, audience string) (string, error) {
+	now := time.Now()
+	id, err := randhex32()
+	if err != nil {
+		return "", err
+	}
+	return signJWT(jwt.Claims{
+		Issuer:   "https://" + *host,
+		Subject:  user,
+		Audience: jwt.Audience{audience},
+		Expiry:   jwt.NewNumericDate(now.Add(*federateTTL)),
+		IssuedAt: jwt.NewNumericDate(now),
+		ID:       id,
+	}, federateClaims{Email: user, Groups: groups, TokenUse: "federation"})
+}
+
 func federateVerify(w http.ResponseWriter, r *http.Request) {
 	// authenticate relying party
 	token := r.URL.Query().Get("token")
+	if strings.Count(token, ".") == 2 {
+		// other JWTs signed by beyond must not pass as federation tokens
+		aud := r.URL.Query().Get("aud")
+		if aud == "" {
+			http.Error(w, "missing aud", 400)
+			return
+		}
+		extra := &federateClaims{}
+		claims, err := verifyJWT(token, jwt.Expected{Issuer: "https://" + *host, Audience: jwt.Audience{aud}}, extra)
+		if err == nil && extra.TokenUse != "federation" {
+			err = errors.New("not a federation token")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"email": claims.Subject, "groups": extra.Groups, "aud": claims.Audience})
+		return
+	}
+
 	err := securecookie.DecodeMulti("user", token, &token, federateSecretCodec...)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
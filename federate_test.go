@@ -1,14 +1,19 @@
 package beyond
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/go-jose/go-jose.v2"
+	"gopkg.in/go-jose/go-jose.v2/jwt"
 )
 
 var (
@@ -119,3 +124,76 @@ func TestFederateVerify500(t *testing.T) {
 	assert.Equal(t, 500, resp.StatusCode)
 	assert.Equal(t, "securecookie: no codecs provided\n", string(body))
 }
+
+func TestFederateJWT(t *testing.T) {
+	assert.NoError(t, signingSetup())
+	*federateAccessKey = "9zcNzr9ObeWnNExMXYbeXxy9CxMMz6FS6ZhSfYRwzXHTNa3ZJo7uFQ2qsWZ5u1Id"
+	*federateSecretKey = "S6ZhSfYRwzXHTNa3ZJo7uFQ2qsWZ5u1Id9zcNzr9ObeWnNExMXYbeXxy9CxMMz6F"
+	assert.NoError(t, federateSetup())
+	*federateJWT = true
+	defer func() { *federateJWT = false }()
+
+	next, err := securecookie.EncodeMulti("next", "https://rp.myorg.net/callback?token=", federateAccessCodec...)
+	assert.NoError(t, err)
+	request := httptest.NewRequest("GET", "/federate?next="+url.QueryEscape(next), nil)
+	request.Host = *host
+	vals := map[string]interface{}{"user": "cloud@user.com", "groups": []string{"staff"}}
+	cookieValue, err := securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
+	assert.NoError(t, err)
+	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookieValue})
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 302, w.Result().StatusCode)
+	location := w.Result().Header.Get("Location")
+	assert.True(t, strings.HasPrefix(location, "https://rp.myorg.net/callback?token="))
+	token := strings.TrimPrefix(location, "https://rp.myorg.net/callback?token=")
+
+	// relying parties verify offline with the JWKS
+	request = httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	keys := jose.JSONWebKeySet{}
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&keys))
+	assert.Len(t, keys.Keys, 1)
+	assert.True(t, keys.Keys[0].IsPublic())
+
+	parsed, err := jwt.ParseSigned(token)
+	assert.NoError(t, err)
+	claims, extra := jwt.Claims{}, federateClaims{}
+	assert.NoError(t, parsed.Claims(keys.Key(parsed.Headers[0].KeyID)[0], &claims, &extra))
+	assert.NoError(t, claims.Validate(jwt.Expected{Issuer: "https://" + *host, Audience: jwt.Audience{"https://rp.myorg.net"}, Time: time.Now()}))
+	assert.Equal(t, "cloud@user.com", claims.Subject)
+	assert.Equal(t, []string{"staff"}, extra.Groups)
+	assert.Equal(t, jwt.ErrExpired, claims.Validate(jwt.Expected{Time: time.Now().Add(*federateTTL + 2*time.Minute)}))
+
+	// and /federate/verify still answers
+	request = httptest.NewRequest("GET", "/federate/verify?aud=https%3A%2F%2Frp.myorg.net&token="+token, nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	v := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&v))
+	assert.Equal(t, "cloud@user.com", v["email"])
+
+	request = httptest.NewRequest("GET", "/federate/verify?aud=https%3A%2F%2Fother.myorg.net&token="+token, nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	request = httptest.NewRequest("GET", "/federate/verify?token="+token, nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 400, w.Result().StatusCode)
+
+	// other JWTs signed by beyond are not federation tokens
+	other, err := signJWT(jwt.Claims{Issuer: "https://" + *host, Subject: "cloud@user.com", Audience: jwt.Audience{"https://rp.myorg.net"}, Expiry: jwt.NewNumericDate(time.Now().Add(time.Minute))})
+	assert.NoError(t, err)
+	request = httptest.NewRequest("GET", "/federate/verify?aud=https%3A%2F%2Frp.myorg.net&token="+other, nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+}
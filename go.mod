@@ -5,6 +5,7 @@ go 1.23.0
 toolchain go1.24.3
 
 require (
+	github.com/beevik/etree v1.1.1-0.20200718192613-4a2f8b9d084c
 	github.com/cogolabs/wait v0.0.0-20200531154825-18b10c34d00e
 	github.com/coreos/go-oidc v2.4.0+incompatible
 	github.com/crewjam/saml v0.4.14
@@ -20,11 +21,11 @@ require (
 	github.com/sirupsen/logrus v1.7.0
 	github.com/stretchr/testify v1.8.1
 	golang.org/x/oauth2 v0.30.0
+	gopkg.in/go-jose/go-jose.v2 v2.6.3
 	inet.af/tcpproxy v0.0.0-20220326234310-be3ee21c9fa0
 )
 
 require (
-	github.com/beevik/etree v1.1.1-0.20200718192613-4a2f8b9d084c // indirect
 	github.com/crewjam/httperr v0.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fortytw2/leaktest v1.3.0 // indirect
@@ -36,6 +37,5 @@ require (
 	github.com/pquerna/cachecontrol v0.2.0 // indirect
 	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
-	gopkg.in/go-jose/go-jose.v2 v2.6.3 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"golang.org/x/oauth2"
 )
@@ -15,22 +17,52 @@ func handleLaunch(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		session = store.New(*cookieName)
 	}
-	if samlSP != nil && samlFilter(w, r) {
-		next, _ := session.Values["next"].(string)
-		jsRedirect(w, next)
-		return
+	if samlMiddleware() != nil {
+		ok, err := samlFilter(w, r)
+		if err != nil {
+			errorHandler(w, 403, err.Error())
+			return
+		}
+		if ok {
+			next, _ := session.Values["next"].(string)
+			jsRedirect(w, next)
+			return
+		}
 	}
 
-	session.Values["next"] = r.URL.Query().Get("next")
+	next := r.URL.Query().Get("next")
+	if next == "" {
+		next = "https://" + *host + "/"
+	}
+	if !nextAllowed(next) {
+		errorHandler(w, 400, "Invalid Redirect")
+		return
+	}
+	session.Values["next"] = next
 	state, _ := randhex32()
 	session.Values["state"] = state
-	session.Save(w)
+	maxAge := stepUpLaunch(r)
+	session.Values["max_age"] = maxAge
 
-	if *samlIDP == "" {
-		next := oidcConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
-		jsRedirect(w, next)
+	if samlMiddleware() == nil {
+		p := oidcProviderChoose(r)
+		if p == nil {
+			oidcChooser(w, r)
+			return
+		}
+		var opts []oauth2.AuthCodeOption
+		if hint := r.URL.Query().Get("login_hint"); hint != "" {
+			opts = append(opts, oauth2.SetAuthURLParam("login_hint", hint))
+		}
+		if maxAge > 0 {
+			opts = append(opts, oauth2.SetAuthURLParam("prompt", "login"), oauth2.SetAuthURLParam("max_age", strconv.Itoa(maxAge)))
+		}
+		authURL := oidcAuthCodeURL(p, session, state, opts...)
+		session.Save(w)
+		jsRedirect(w, authURL)
 	} else {
-		samlSP.HandleStartAuthFlow(w, r)
+		session.Save(w)
+		samlStartAuthFlow(w, r, maxAge > 0)
 	}
 }
 
@@ -51,36 +83,117 @@ func handleOIDC(w http.ResponseWriter, r *http.Request) {
 		errorHandler(w, 403, "Invalid Browser State")
 		return
 	}
-	email, err := oidcVerify(r.URL.Query().Get("code"))
+	id, _ := session.Values["provider"].(string)
+	p := oidcProviderGet(id)
+	if p == nil {
+		errorHandler(w, 400, "Unknown Provider")
+		return
+	}
+	claims, err := oidcVerify(p, r.URL.Query().Get("code"), session)
 	if err != nil {
 		errorHandler(w, 401, err.Error())
 		return
 	}
-	session.Values["user"] = email
+	user, err := oidcIdentity(p, claims)
+	if err != nil {
+		WithError(err).WithFields(map[string]interface{}{"user": claims.Email, "provider": p.ID}).Info("login rejected")
+		errorHandler(w, 403, err.Error())
+		return
+	}
+	// the IdP must not reuse an older login for a step-up
+	if maxAge, _ := session.Values["max_age"].(int); maxAge > 0 && (claims.AuthTime == 0 ||
+		time.Since(time.Unix(claims.AuthTime, 0)) > time.Duration(maxAge)*time.Second+time.Minute) {
+		errorHandler(w, 401, "Re-authentication Required")
+		return
+	}
+	authTime := claims.AuthTime
+	if authTime == 0 {
+		authTime = time.Now().Unix()
+	}
+	sessionRenew(session)
+	session.Values["user"] = user
+	session.Values["groups"] = claims.Groups
+	session.Values["refresh"] = claims.RefreshToken
+	session.Values["refreshed"] = time.Now().Unix()
+	session.Values["auth_time"] = authTime
+	sessionLogin(session)
 	next, _ := session.Values["next"].(string)
 	session.Values["next"] = ""
 	session.Values["state"] = ""
+	session.Values["nonce"] = ""
+	session.Values["verifier"] = ""
+	session.Values["max_age"] = 0
 	session.Save(w)
 
 	http.Redirect(w, r, next, http.StatusFound)
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
+	headerStrip(r.Header)
+
 	// check for cookie authentication
 	session, err := store.Get(r, *cookieName)
 	if err != nil {
 		session = store.New(*cookieName)
 	}
 	user, _ := session.Values["user"].(string)
+	groups, _ := session.Values["groups"].([]string)
+
+	// expire idle and old sessions
+	if user != "" && !sessionActive(w, session) {
+		WithField("user", user).Info("session expired")
+		sessionReset(session)
+		session.Save(w)
+		user, groups = "", nil
+	}
+
+	// re-validate with the IdP
+	if user != "" && !oidcRefresh(w, session) {
+		WithField("user", user).Info("session refresh rejected")
+		sessionReset(session)
+		session.Save(w)
+		user, groups = "", nil
+	}
+	authTime, _ := session.Values["auth_time"].(int64)
+	interactive := user != ""
+
+	// check for client certificate
+	if user == "" {
+		user = userNormalize(clientCertUser(r))
+	}
+
+	// check for service account key
+	var account *serviceAccount
+	if user == "" {
+		account = accountAuth(r)
+		if account != nil {
+			user = account.Name
+			accountKeyStrip(r)
+		}
+	}
+
+	// check for device flow or CLI token
+	if user == "" {
+		user, groups, authTime = accessTokenUser(r)
+		interactive = user != ""
+		if interactive {
+			accessTokenStrip(r)
+		}
+	}
 
 	// check for oauth2 token
+	var principals []string
 	if user == "" {
-		user = tokenAuth(r)
+		user, principals = tokenIdentify(r)
+		user = userNormalize(user)
 	}
 	if user != "" {
 		r.Header.Set(*headerPrefix+"-User", user)
+		assertionSet(r, user, append(groups, principals...), authTime)
 	}
 
+	cookieStrip(r.Header)
+
 	// apply allowlist
 	if allowlisted(r) {
 		nexthop(w, r)
@@ -100,16 +213,30 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// apply fence
-	if deny(r, user) {
+	if deny(r, append(fencePrincipals(user, groups), principals...)...) || (account != nil && denyZones(r, account.zones)) {
 		errorHandler(w, 403, "Access Denied")
 		return
 	}
 
+	// require a recent login for sensitive sites
+	if interactive {
+		if maxAge, ok := stepUpRequired(r, authTime); ok {
+			WithField("user", user).Info("step-up login required")
+			stepUpLogin(w, r, maxAge)
+			return
+		}
+	}
+
 	// allow
 	nexthop(w, r)
 }
 
 func login(w http.ResponseWriter, r *http.Request) {
+	loginQuery(w, r, url.Values{})
+}
+
+// loginQuery sends the user to /launch with extra query parameters
+func loginQuery(w http.ResponseWriter, r *http.Request, query url.Values) {
 	if w == nil {
 		return
 	}
@@ -122,21 +249,8 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsRedirect(w, "https://"+*host+"/launch?next="+url.QueryEscape("https://"+r.Host+r.RequestURI))
-}
-
-func jsRedirect(w http.ResponseWriter, next string) {
-	if w == nil {
-		return
-	}
-
-	// hack to guarantee interactive session
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprintf(w, `
-<script type="text/javascript">
-window.location.replace("%s");
-</script>
-`, next)
+	query.Set("next", "https://"+r.Host+r.RequestURI)
+	jsRedirect(w, "https://"+*host+"/launch?"+query.Encode())
 }
 
 func setCacheControl(w http.ResponseWriter) {
@@ -40,11 +40,12 @@ func TestHandlerGo(t *testing.T) {
 	body, _ := io.ReadAll(resp.Body)
 	assert.Equal(t, *fouroOneCode, resp.StatusCode)
 	assert.Equal(t, "", resp.Header.Get("Set-Cookie"))
-	assert.Equal(t, "\n<script type=\"text/javascript\">\nwindow.location.replace(\"https://"+*host+"/launch?next=https%3A%2F%2Fgithub.com%2Ftest%3Fa%3D1\");\n</script>\n", string(body))
+	next := "https://" + *host + "/launch?next=https%3A%2F%2Fgithub.com%2Ftest%3Fa%3D1"
+	assert.Equal(t, "<!DOCTYPE html>\n<html lang=\"en\">\n\t<head>\n\t\t<meta charset=\"utf-8\" /><meta name=\"viewport\" content=\"width=device-width, initial-scale=1\" />\n\t\t<title>Redirecting</title>\n\t\t<script type=\"text/javascript\">window.location.replace(\""+next+"\");</script>\n\t</head>\n\t<body>\n\t\t<noscript><a href=\""+next+"\">Continue</a></noscript>\n\t</body>\n</html>", string(body))
 }
 
 func TestHandlerLaunch(t *testing.T) {
-	request := httptest.NewRequest("GET", "/launch?next=https%3A%2F%2Falachart.colofoo.net%2Ftest%3Fa%3D1", nil)
+	request := httptest.NewRequest("GET", "/launch?next=https%3A%2F%2Falachart.myorg.net%2Ftest%3Fa%3D1", nil)
 	request.Host = *host
 	w := httptest.NewRecorder()
 	testMux.ServeHTTP(w, request)
@@ -85,6 +86,7 @@ func TestHandlerOidcStateInvalid(t *testing.T) {
 func TestHandlerOidcStateValid(t *testing.T) {
 	session := store.New(*cookieName)
 	session.Values["state"] = "test1"
+	session.Values["nonce"] = "nonce1"
 	recorder := httptest.NewRecorder()
 	assert.NoError(t, store.Save(recorder, session))
 	cookie := strings.Split(recorder.Header().Get("Set-Cookie"), ";")[0]
@@ -101,6 +103,26 @@ func TestHandlerOidcStateValid(t *testing.T) {
 	assert.Contains(t, string(body), "oauth2:")
 }
 
+func TestHandlerGroups(t *testing.T) {
+	session := store.New(*cookieName)
+	session.Values["user"] = "someone@gmail.com"
+	session.Values["groups"] = []string{"contractors"}
+	recorder := httptest.NewRecorder()
+	assert.NoError(t, store.Save(recorder, session))
+	cookie := strings.Split(recorder.Header().Get("Set-Cookie"), ";")[0]
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = "sentry8.colofoo.net"
+	request.Header.Set("Cookie", cookie)
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Contains(t, string(body), "Access Denied")
+}
+
 func TestHandlerWebsocket(t *testing.T) {
 	t.SkipNow()
 
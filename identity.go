@@ -0,0 +1,116 @@
+package beyond
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var (
+	userLowercase  = flag.Bool("user-lowercase", false, "lowercase users from every login and token source")
+	userAliasesURL = flag.String("user-aliases-url", "", "URL or file of a JSON map of user aliases to canonical users (eg. https://github.com/myorg/beyond-config/main/raw/aliases.json)")
+	userDomains    = flag.String("user-domains", "", "CSV of email domains allowed to log in with OIDC or SAML (blank allows all)")
+	oidcHD         = flag.String("oidc-hosted-domain", "", "Google Workspace domain required in the hd claim of -oidc-issuer logins (blank disables)")
+
+	userAliases = concurrentMapString{m: map[string]string{}}
+
+	errEmailUnverified = errors.New("email address not verified")
+	errDomainDenied    = errors.New("email domain not allowed")
+)
+
+func refreshUserAliases() error {
+	if *userAliasesURL == "" {
+		return nil
+	}
+
+	body, err := configOpen(*userAliasesURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	aliases := map[string]string{}
+	err = json.NewDecoder(body).Decode(&aliases)
+	if err != nil {
+		return err
+	}
+
+	m := map[string]string{}
+	for alias, user := range aliases {
+		if alias == "" || user == "" {
+			return fmt.Errorf("invalid user alias: %q=%q", alias, user)
+		}
+		m[userFold(alias)] = userFold(user)
+	}
+
+	userAliases.Lock()
+	userAliases.m = m
+	userAliases.Unlock()
+	return nil
+}
+
+func userFold(user string) string {
+	user = strings.TrimSpace(user)
+	if *userLowercase {
+		user = strings.ToLower(user)
+	}
+	return user
+}
+
+// userNormalize folds the case of a user and resolves its alias, if any
+func userNormalize(user string) string {
+	user = userFold(user)
+	if user == "" {
+		return ""
+	}
+	userAliases.RLock()
+	alias := userAliases.m[user]
+	userAliases.RUnlock()
+	if alias != "" {
+		return alias
+	}
+	return user
+}
+
+// userDomainAllowed checks an interactive login against -user-domains
+func userDomainAllowed(user string) error {
+	if *userDomains == "" {
+		return nil
+	}
+	i := strings.LastIndex(user, "@")
+	if i < 0 {
+		return errDomainDenied
+	}
+	for _, d := range strings.Split(*userDomains, ",") {
+		if strings.EqualFold(strings.TrimSpace(d), user[i+1:]) {
+			return nil
+		}
+	}
+	return errDomainDenied
+}
+
+// oidcIdentity applies the identity rules to the claims of an OIDC login
+// through provider p
+func oidcIdentity(p *oidcProvider, claims *oidcClaims) (string, error) {
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		if !v {
+			return "", errEmailUnverified
+		}
+	case string:
+		if strings.EqualFold(v, "false") {
+			return "", errEmailUnverified
+		}
+	}
+	if !p.emailAllowed(claims.Email) {
+		return "", errDomainDenied
+	}
+	// hd is a Google claim, so it only binds the -oidc-issuer provider
+	if *oidcHD != "" && p.ID == oidcDefaultID && !strings.EqualFold(claims.HostedDomain, *oidcHD) {
+		return "", errDomainDenied
+	}
+
+	user := userNormalize(claims.Email)
+	return user, userDomainAllowed(user)
+}
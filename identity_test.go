@@ -0,0 +1,108 @@
+package beyond
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityNormalize(t *testing.T) {
+	prevAliases, prevDomains := *userAliasesURL, *userDomains
+	defer func() {
+		*userLowercase, *userAliasesURL, *userDomains, *oidcHD = false, prevAliases, prevDomains, ""
+		userAliases.m = map[string]string{}
+	}()
+
+	assert.Equal(t, "Bob@Corp.com", userNormalize(" Bob@Corp.com"))
+	*userLowercase = true
+	assert.Equal(t, "bob@corp.com", userNormalize("Bob@Corp.com "))
+
+	path := filepath.Join(t.TempDir(), "aliases.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"Robert@Corp.com": "bob@corp.com", "bob@corp.io": "bob@corp.com"}`), 0600))
+	*userAliasesURL = path
+	assert.NoError(t, refreshUserAliases())
+	assert.Equal(t, "bob@corp.com", userNormalize("robert@corp.com"))
+	assert.Equal(t, "bob@corp.com", userNormalize("BOB@corp.io"))
+	assert.Equal(t, "", userNormalize(""))
+
+	assert.NoError(t, userDomainAllowed("bob@corp.com"))
+	*userDomains = "corp.com, corp.io"
+	assert.NoError(t, userDomainAllowed("bob@CORP.com"))
+	assert.Equal(t, errDomainDenied, userDomainAllowed("bob@gmail.com"))
+	assert.Equal(t, errDomainDenied, userDomainAllowed("bob"))
+
+	user, err := oidcIdentity(oidcDefault(), &oidcClaims{Email: "Robert@Corp.com", EmailVerified: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "bob@corp.com", user)
+	_, err = oidcIdentity(oidcDefault(), &oidcClaims{Email: "bob@corp.com", EmailVerified: false})
+	assert.Equal(t, errEmailUnverified, err)
+	_, err = oidcIdentity(oidcDefault(), &oidcClaims{Email: "bob@corp.com", EmailVerified: "false"})
+	assert.Equal(t, errEmailUnverified, err)
+	_, err = oidcIdentity(oidcDefault(), &oidcClaims{Email: "bob@gmail.com"})
+	assert.Equal(t, errDomainDenied, err)
+
+	*oidcHD = "corp.com"
+	_, err = oidcIdentity(oidcDefault(), &oidcClaims{Email: "bob@corp.com"})
+	assert.Equal(t, errDomainDenied, err)
+	_, err = oidcIdentity(oidcDefault(), &oidcClaims{Email: "bob@corp.com", HostedDomain: "corp.com"})
+	assert.NoError(t, err)
+
+	// other providers have no hd claim
+	partner := &oidcProvider{ID: "partner", Domain: "corp.io"}
+	_, err = oidcIdentity(partner, &oidcClaims{Email: "bob@corp.io"})
+	assert.NoError(t, err)
+	_, err = oidcIdentity(partner, &oidcClaims{Email: "bob@corp.com", HostedDomain: "corp.com"})
+	assert.Equal(t, errDomainDenied, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"bob@corp.io": ""}`), 0600))
+	assert.EqualError(t, refreshUserAliases(), `invalid user alias: "bob@corp.io"=""`)
+}
+
+func TestIdentityFence(t *testing.T) {
+	prevFence, prevSites, prevURL := fence.m, sites.m, *fenceURL
+	defer func() {
+		*userLowercase, *fenceURL = false, prevURL
+		fence.m, sites.m = prevFence, prevSites
+	}()
+	*userLowercase = true
+	path := filepath.Join(t.TempDir(), "fence.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"Bob@Corp.com": ["git"], "bob@corp.com ": ["wiki"], "group:Contractors": ["git"]}`), 0600))
+	*fenceURL = "file://" + path
+	assert.NoError(t, refreshFence())
+	sites.m = map[string]map[string]bool{"git": {"https://git.myorg.net": true}, "wiki": {"https://wiki.myorg.net": true}}
+
+	// fence entries still restrict users once they are folded
+	git, _ := http.NewRequest("GET", "https://git.myorg.net/", nil)
+	wiki, _ := http.NewRequest("GET", "https://wiki.myorg.net/", nil)
+	other, _ := http.NewRequest("GET", "https://other.myorg.net/", nil)
+	assert.False(t, deny(git, userNormalize("BOB@corp.com")))
+	assert.False(t, deny(wiki, userNormalize("BOB@corp.com")))
+	assert.True(t, deny(other, userNormalize("BOB@corp.com")))
+	assert.True(t, deny(other, fencePrincipals("carol@corp.com", []string{"contractors"})...))
+}
+
+func TestIdentityLoginRejected(t *testing.T) {
+	defer func() { *userDomains = "" }()
+	*userDomains = "corp.com"
+
+	mock := &oidcMock{}
+	oidcConfig = mock
+	oidcVerifier = mock
+
+	request := httptest.NewRequest("GET", "/oidc?state=barbaz", nil)
+	vals := map[string]interface{}{"state": "barbaz", "nonce": "nonce1", "next": "https://" + *host + "/next"}
+	cookieValue, err := securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
+	assert.NoError(t, err)
+	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookieValue})
+	request.Host = *host
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "email domain not allowed")
+	assert.Empty(t, w.Result().Cookies())
+}
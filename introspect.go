@@ -0,0 +1,97 @@
+package beyond
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+var (
+	tokenIntrospect       = flag.String("token-introspect", "", "RFC 7662 token introspection endpoint URL (blank disables)")
+	tokenIntrospectID     = flag.String("token-introspect-client-id", "", "client ID for the token introspection endpoint")
+	tokenIntrospectSecret = flag.String("token-introspect-client-secret", "", "client secret for the token introspection endpoint")
+	tokenIntrospectUser   = flag.String("token-introspect-user", "username", "introspection field to map to the user: {username, sub, email}")
+	tokenIntrospectScope  = flag.String("token-introspect-scope", "", "space-separated scopes an introspected token must have")
+)
+
+type introspection struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	Exp      int64  `json:"exp"`
+	Username string `json:"username"`
+	Sub      string `json:"sub"`
+	Email    string `json:"email"`
+}
+
+// tokenIntrospection asks the introspection endpoint about a token and
+// returns its user with how long the answer may be cached
+func tokenIntrospection(token string) (string, time.Duration, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest("POST", *tokenIntrospect, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if *tokenIntrospectID != "" {
+		req.SetBasicAuth(url.QueryEscape(*tokenIntrospectID), url.QueryEscape(*tokenIntrospectSecret))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", 0, fmt.Errorf("token introspection: %s", resp.Status)
+	}
+	v := &introspection{}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// cache no longer than the token cache default, so revocations apply
+	ttl := cache.DefaultExpiration
+	if v.Exp > 0 {
+		until := time.Until(time.Unix(v.Exp, 0))
+		if until <= 0 {
+			return "", cache.DefaultExpiration, nil
+		}
+		if until < tokenCacheTTL {
+			ttl = until
+		}
+	}
+	if !v.Active || !introspectionScoped(v.Scope, *tokenIntrospectScope) {
+		return "", ttl, nil
+	}
+
+	switch *tokenIntrospectUser {
+	case "sub":
+		return v.Sub, ttl, nil
+	case "email":
+		return v.Email, ttl, nil
+	default:
+		return v.Username, ttl, nil
+	}
+}
+
+// introspectionScoped reports whether granted includes every required scope
+func introspectionScoped(granted, required string) bool {
+	scopes := map[string]bool{}
+	for _, s := range strings.Fields(granted) {
+		scopes[s] = true
+	}
+	for _, s := range strings.Fields(required) {
+		if !scopes[s] {
+			return false
+		}
+	}
+	return true
+}
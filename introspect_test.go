@@ -0,0 +1,83 @@
+package beyond
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenIntrospect(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "beyond" || secret != "s3cret" {
+			w.WriteHeader(401)
+			return
+		}
+		v := map[string]interface{}{"active": false}
+		switch r.PostFormValue("token") {
+		case "intro-soon":
+			v = map[string]interface{}{"active": true, "scope": "repo", "exp": time.Now().Add(2 * time.Minute).Unix(), "username": "user4"}
+		case "intro-active":
+			v = map[string]interface{}{"active": true, "scope": "read repo", "exp": exp, "username": "user1", "sub": "u-1", "email": "user1@myorg.net"}
+		case "intro-unscoped":
+			v = map[string]interface{}{"active": true, "scope": "read", "username": "user2"}
+		case "intro-expired":
+			v = map[string]interface{}{"active": true, "scope": "repo", "exp": time.Now().Add(-time.Minute).Unix(), "username": "user3"}
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	defer server.Close()
+
+	prev := []string{*tokenIntrospect, *tokenIntrospectID, *tokenIntrospectSecret, *tokenIntrospectUser, *tokenIntrospectScope}
+	defer func() {
+		*tokenIntrospect, *tokenIntrospectID, *tokenIntrospectSecret, *tokenIntrospectUser, *tokenIntrospectScope = prev[0], prev[1], prev[2], prev[3], prev[4]
+	}()
+	*tokenIntrospect = server.URL
+	*tokenIntrospectID = "beyond"
+	*tokenIntrospectSecret = "s3cret"
+	*tokenIntrospectScope = "repo"
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer intro-active")
+	assert.Equal(t, "user1", tokenAuth(r))
+	_, expires, ok := tokenCache.GetWithExpiration("intro-active")
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(tokenCacheTTL), expires, 2*time.Second)
+	r.Header.Set("Authorization", "Bearer intro-soon")
+	assert.Equal(t, "user4", tokenAuth(r))
+	_, expires, _ = tokenCache.GetWithExpiration("intro-soon")
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), expires, 2*time.Second)
+
+	for _, token := range []string{"intro-unscoped", "intro-expired", "intro-inactive"} {
+		r.Header.Set("Authorization", "Bearer "+token)
+		assert.Equal(t, "", tokenAuth(r), token)
+	}
+
+	// tokens the endpoint does not know fall through to the token providers
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gh-token" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(`{"login": "octocat"}`))
+	}))
+	defer github.Close()
+	tokenProviders.list = []*tokenProvider{{Name: "github", URL: github.URL, User: "login"}}
+	defer func() { tokenProviders.list = nil }()
+	r.Header.Set("Authorization", "Bearer gh-token")
+	assert.Equal(t, "octocat", tokenAuth(r))
+
+	*tokenIntrospectUser = "email"
+	user, _, err := tokenIntrospection("intro-active")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1@myorg.net", user)
+
+	*tokenIntrospectSecret = "wrong"
+	_, _, err = tokenIntrospection("intro-active")
+	assert.EqualError(t, err, "token introspection: 401 Unauthorized")
+}
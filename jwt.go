@@ -0,0 +1,132 @@
+package beyond
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"sync"
+
+	oidc "github.com/coreos/go-oidc"
+	jose "gopkg.in/go-jose/go-jose.v2"
+)
+
+var (
+	tokenJWKS     = flag.String("token-jwks", "", "JWKS URL or file for validating JWT bearer tokens locally (blank disables)")
+	tokenJWTIss   = flag.String("token-jwt-issuer", "", "issuer of JWT bearer tokens (required with token-jwks)")
+	tokenJWTAud   = flag.String("token-jwt-audience", "", "audience of JWT bearer tokens (required with token-jwks)")
+	tokenJWTClaim = flag.String("token-jwt-claim", "sub", "JWT bearer token claim to map to the user")
+
+	tokenJWTKeys     *jwksFile
+	tokenJWTVerifier *oidc.IDTokenVerifier
+)
+
+func tokenJWTSetup() error {
+	tokenJWTKeys, tokenJWTVerifier = nil, nil
+	if *tokenJWKS == "" {
+		return nil
+	}
+	// a shared JWKS (eg. GitHub Actions) signs tokens for everyone
+	if *tokenJWTIss == "" || *tokenJWTAud == "" {
+		return errors.New("token-jwks requires token-jwt-issuer and token-jwt-audience")
+	}
+
+	var keySet oidc.KeySet
+	if strings.HasPrefix(*tokenJWKS, "https://") || strings.HasPrefix(*tokenJWKS, "http://") {
+		keySet = oidc.NewRemoteKeySet(context.Background(), *tokenJWKS)
+	} else {
+		tokenJWTKeys = &jwksFile{path: *tokenJWKS}
+		err := tokenJWTKeys.load()
+		if err != nil {
+			return err
+		}
+		keySet = tokenJWTKeys
+	}
+
+	tokenJWTVerifier = oidc.NewVerifier(*tokenJWTIss, keySet, &oidc.Config{
+		ClientID: *tokenJWTAud,
+		SupportedSigningAlgs: []string{
+			oidc.RS256, oidc.RS384, oidc.RS512,
+			oidc.ES256, oidc.ES384, oidc.ES512,
+			oidc.PS256, oidc.PS384, oidc.PS512,
+		},
+	})
+	return nil
+}
+
+// tokenJWT validates a JWT bearer token and returns its user claim
+func tokenJWT(token string) string {
+	idToken, err := tokenJWTVerifier.Verify(context.Background(), token)
+	if err != nil {
+		WithError(err).Info("jwt rejected")
+		return ""
+	}
+	claims := map[string]interface{}{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		Error(err)
+		return ""
+	}
+	user, _ := claims[*tokenJWTClaim].(string)
+	return user
+}
+
+// refreshJWKS reloads a file-based JWKS; remote sets refresh on unknown key IDs
+func refreshJWKS() error {
+	if tokenJWTKeys == nil {
+		return nil
+	}
+	return tokenJWTKeys.load()
+}
+
+// jwksFile is an oidc.KeySet read from a local JWKS file
+type jwksFile struct {
+	sync.RWMutex
+	path string
+	keys jose.JSONWebKeySet
+}
+
+func (f *jwksFile) load() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	keys := jose.JSONWebKeySet{}
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return err
+	}
+	if len(keys.Keys) < 1 {
+		return errors.New("no keys in JWKS: " + f.path)
+	}
+	f.Lock()
+	f.keys = keys
+	f.Unlock()
+	return nil
+}
+
+func (f *jwksFile) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, err
+	}
+	kid := ""
+	if len(jws.Signatures) > 0 {
+		kid = jws.Signatures[0].Header.KeyID
+	}
+
+	f.RLock()
+	defer f.RUnlock()
+	for _, key := range f.keys.Keys {
+		if kid != "" && key.KeyID != kid {
+			continue
+		}
+		payload, err := jws.Verify(key)
+		if err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("failed to verify JWT signature")
+}
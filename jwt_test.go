@@ -0,0 +1,95 @@
+package beyond
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/go-jose/go-jose.v2"
+	"gopkg.in/go-jose/go-jose.v2/jwt"
+)
+
+func jwtTestKey(t *testing.T) (*ecdsa.PrivateKey, jose.JSONWebKeySet) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return key, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: "ES256", Use: "sig"}}}
+}
+
+func jwtTestSign(t *testing.T, key *ecdsa.PrivateKey, claims interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "k1"))
+	assert.NoError(t, err)
+	raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	assert.NoError(t, err)
+	return raw
+}
+
+func TestTokenJWT(t *testing.T) {
+	prev := []string{*tokenJWKS, *tokenJWTIss, *tokenJWTAud, *tokenJWTClaim}
+	defer func() {
+		*tokenJWKS, *tokenJWTIss, *tokenJWTAud, *tokenJWTClaim = prev[0], prev[1], prev[2], prev[3]
+		assert.NoError(t, tokenJWTSetup())
+	}()
+
+	key, keys := jwtTestKey(t)
+	data, err := json.Marshal(keys)
+	assert.NoError(t, err)
+	*tokenJWKS = filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(*tokenJWKS, data, 0600))
+	*tokenJWTIss = "https://ci.myorg.net"
+	*tokenJWTAud = ""
+	assert.EqualError(t, tokenJWTSetup(), "token-jwks requires token-jwt-issuer and token-jwt-audience")
+	*tokenJWTAud = "beyond"
+	*tokenJWTClaim = "email"
+	assert.NoError(t, tokenJWTSetup())
+	assert.NoError(t, refreshJWKS())
+
+	now := time.Now()
+	valid := map[string]interface{}{
+		"iss": "https://ci.myorg.net", "aud": "beyond", "sub": "job-1", "email": "ci@myorg.net",
+		"exp": now.Add(time.Minute).Unix(), "iat": now.Unix(),
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+jwtTestSign(t, key, valid))
+	assert.Equal(t, "ci@myorg.net", tokenAuth(r))
+
+	for claim, value := range map[string]interface{}{
+		"iss": "https://evil.myorg.net",
+		"aud": "other",
+		"exp": now.Add(-time.Minute).Unix(),
+	} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[claim] = value
+		r.Header.Set("Authorization", "Bearer "+jwtTestSign(t, key, claims))
+		assert.Equal(t, "", tokenAuth(r), claim)
+	}
+
+	other, _ := jwtTestKey(t)
+	r.Header.Set("Authorization", "Bearer "+jwtTestSign(t, other, valid))
+	assert.Equal(t, "", tokenAuth(r))
+
+	// remote JWKS
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	}))
+	defer jwksServer.Close()
+	*tokenJWKS = jwksServer.URL
+	*tokenJWTClaim = "sub"
+	assert.NoError(t, tokenJWTSetup())
+	r.Header.Set("Authorization", "Bearer "+jwtTestSign(t, key, valid))
+	assert.Equal(t, "job-1", tokenAuth(r))
+
+	*tokenJWKS = filepath.Join(t.TempDir(), "missing.json")
+	assert.Error(t, tokenJWTSetup())
+}
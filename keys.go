@@ -0,0 +1,134 @@
+package beyond
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	jose "gopkg.in/go-jose/go-jose.v2"
+	"gopkg.in/go-jose/go-jose.v2/jwt"
+)
+
+var (
+	signingKeyFile = flag.String("signing-key-file", "", "PEM EC or RSA private key for JWTs issued by beyond (blank generates one per start)")
+
+	signingKey    *jose.JSONWebKey
+	signingSigner jose.Signer
+)
+
+// signingSetup loads or generates the key for JWTs issued by beyond.
+// Instances behind a load balancer must share a -signing-key-file.
+func signingSetup() error {
+	var (
+		key interface{}
+		err error
+	)
+	if *signingKeyFile == "" {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		key, err = signingKeyLoad(*signingKeyFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	var alg jose.SignatureAlgorithm
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			alg = jose.ES256
+		case elliptic.P384():
+			alg = jose.ES384
+		case elliptic.P521():
+			alg = jose.ES512
+		}
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	}
+	if alg == "" {
+		return fmt.Errorf("unsupported signing key: %T", key)
+	}
+
+	jwk := &jose.JSONWebKey{Key: key, Algorithm: string(alg), Use: "sig"}
+	public := jwk.Public()
+	thumbprint, err := public.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: alg, Key: jwk},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return err
+	}
+	signingKey, signingSigner = jwk, signer
+	return nil
+}
+
+func signingKeyLoad(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block in signing-key-file: " + path)
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// signJWT issues a JWT from beyond with the given claims
+func signJWT(claims ...interface{}) (string, error) {
+	builder := jwt.Signed(signingSigner)
+	for _, c := range claims {
+		builder = builder.Claims(c)
+	}
+	return builder.CompactSerialize()
+}
+
+// verifyJWT checks a JWT issued by beyond, including its exp, and decodes
+// the extra claims
+func verifyJWT(raw string, expected jwt.Expected, extra ...interface{}) (*jwt.Claims, error) {
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, err
+	}
+	claims := &jwt.Claims{}
+	err = token.Claims(signingKey.Public(), append([]interface{}{claims}, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, jwt.ErrExpired
+	}
+	expected.Time = time.Now()
+	return claims, claims.Validate(expected)
+}
+
+// handleJWKS publishes the public keys of JWTs issued by beyond
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{signingKey.Public()}})
+}
@@ -0,0 +1,74 @@
+package beyond
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+)
+
+var (
+	logoutIDP      = flag.Bool("logout-idp", false, "also end the IdP session on logout (OIDC end_session_endpoint or SAML Single Logout)")
+	logoutRedirect = flag.String("logout-redirect-url", "", "post_logout_redirect_uri registered with the IdP (blank defaults to https://beyond-host/logout)")
+)
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	setCacheControl(w)
+	session, err := store.Get(r, *cookieName)
+	if err != nil {
+		session = store.New(*cookieName)
+	}
+
+	// returning from the IdP resumes the saved next
+	next := r.URL.Query().Get("next")
+	if next == "" {
+		next, _ = session.Values["next"].(string)
+	}
+	if next == "" || !nextAllowed(next) {
+		next = *homeURL
+	}
+
+	user, _ := session.Values["user"].(string)
+	id, _ := session.Values["provider"].(string)
+	nameID, _ := session.Values["saml_nameid"].(string)
+	sessionReset(session)
+
+	if end := logoutEndSession(id, nameID); user != "" && end != "" {
+		session.Values["next"] = next
+		session.Save(w)
+		http.Redirect(w, r, end, http.StatusFound)
+		return
+	}
+
+	session.Config.MaxAge = -1
+	session.Save(w)
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// logoutEndSession returns the IdP logout URL for a session's provider, if any
+func logoutEndSession(id, nameID string) string {
+	if !*logoutIDP {
+		return ""
+	}
+	if samlMiddleware() != nil {
+		return samlLogoutURL(nameID)
+	}
+	p := oidcProviderGet(id)
+	if p == nil || p.endSession == "" {
+		return ""
+	}
+	u, err := url.Parse(p.endSession)
+	if err != nil {
+		Error(err)
+		return ""
+	}
+
+	postLogout := *logoutRedirect
+	if postLogout == "" {
+		postLogout = "https://" + *host + "/logout"
+	}
+	q := u.Query()
+	q.Set("client_id", p.ClientID)
+	q.Set("post_logout_redirect_uri", postLogout)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,72 @@
+package beyond
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogout(t *testing.T) {
+	vals := map[string]interface{}{"user": "cloud@user.com", "provider": oidcDefaultID}
+	cookieValue, err := securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
+	assert.NoError(t, err)
+
+	request := httptest.NewRequest("GET", "/logout?next=https%3A%2F%2Fgit.myorg.net%2F", nil)
+	request.Host = *host
+	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookieValue})
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+
+	resp := w.Result()
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "https://git.myorg.net/", resp.Header.Get("Location"))
+	assert.Equal(t, *cookieName, resp.Cookies()[0].Name)
+	assert.Equal(t, -1, resp.Cookies()[0].MaxAge)
+	assert.Equal(t, *cookieDom, "."+resp.Cookies()[0].Domain)
+
+	request = httptest.NewRequest("GET", "/logout", nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, *homeURL, w.Result().Header.Get("Location"))
+}
+
+func TestLogoutIDP(t *testing.T) {
+	prevIDP, prevEnd := *logoutIDP, oidcEndSession
+	defer func() { *logoutIDP, oidcEndSession = prevIDP, prevEnd }()
+	*logoutIDP = true
+	oidcEndSession = "https://idp.myorg.net/logout?tenant=1"
+
+	vals := map[string]interface{}{"user": "cloud@user.com", "provider": oidcDefaultID}
+	cookieValue, err := securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
+	assert.NoError(t, err)
+
+	request := httptest.NewRequest("GET", "/logout?next=https%3A%2F%2Fgit.myorg.net%2F", nil)
+	request.Host = *host
+	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookieValue})
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+
+	resp := w.Result()
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "https://idp.myorg.net/logout?client_id="+*oidcClientID+"&post_logout_redirect_uri=https%3A%2F%2F"+*host+"%2Flogout&tenant=1", resp.Header.Get("Location"))
+
+	// the IdP returns to /logout without the user
+	vals = map[string]interface{}{}
+	assert.NoError(t, securecookie.DecodeMulti(*cookieName, resp.Cookies()[0].Value, &vals, store.Codecs...))
+	assert.Nil(t, vals["user"])
+
+	request = httptest.NewRequest("GET", "/logout", nil)
+	request.Host = *host
+	request.AddCookie(resp.Cookies()[0])
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+
+	resp = w.Result()
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "https://git.myorg.net/", resp.Header.Get("Location"))
+	assert.Equal(t, -1, resp.Cookies()[0].MaxAge)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
 )
 
 // HostRewrite contains the rewritten host information
@@ -20,20 +21,35 @@ var (
 	hostsCSV  = flag.String("hosts-csv", "", "rewrite nexthop hosts (format: from1=to1,from2=to2)")
 	hostsURL  = flag.String("hosts-url", "", "URL to host mapping config (eg. https://github.com/myorg/beyond-config/main/raw/hosts.json)")
 	hostsOnly = flag.Bool("hosts-only", false, "only allow requests to hosts in the host mapping")
-	hostsMap  = map[string]string{}
+
+	hostsMap    = concurrentMapString{m: map[string]string{}}
+	hostsStatic = map[string]string{}
 )
 
+type concurrentMapString struct {
+	sync.RWMutex
+	m map[string]string
+}
+
 func hostsSetup(cfg string) error {
 	if cfg == "" {
 		return nil
 	}
+	hostsMap.Lock()
+	defer hostsMap.Unlock()
+	m := map[string]string{}
+	for k, v := range hostsMap.m {
+		m[k] = v
+	}
 	for _, line := range strings.Split(cfg, ",") {
 		elts := strings.Split(line, "=")
 		if len(elts) < 2 {
 			return fmt.Errorf("missing equals assignment in: %+v", line)
 		}
-		hostsMap[elts[0]] = elts[1]
+		hostsStatic[elts[0]] = elts[1]
+		m[elts[0]] = elts[1]
 	}
+	hostsMap.m = m
 	return nil
 }
 
@@ -42,7 +58,7 @@ func refreshHosts() error {
 		return nil
 	}
 
-	resp, err := httpACL.Get(*hostsURL)
+	resp, err := httpACLGet(*hostsURL)
 	if err != nil {
 		return err
 	}
@@ -55,10 +71,20 @@ func refreshHosts() error {
 	}
 
 	// Merge URL config with command-line config
+	m := map[string]string{}
+	for k, v := range hostsStatic {
+		m[k] = v
+	}
 	for k, v := range config {
-		hostsMap[k] = v
+		if k == "" || v == "" {
+			return fmt.Errorf("invalid host mapping: %q=%q", k, v)
+		}
+		m[k] = v
 	}
 
+	hostsMap.Lock()
+	hostsMap.m = m
+	hostsMap.Unlock()
 	return nil
 }
 
@@ -67,12 +93,16 @@ func hostAllowed(host string) bool {
 		return true
 	}
 
+	hostsMap.RLock()
+	m := hostsMap.m
+	hostsMap.RUnlock()
+
 	// If hosts-only is enabled, check if host is in the mapping
-	if len(hostsMap) == 0 {
+	if len(m) == 0 {
 		return false
 	}
 
-	for k := range hostsMap {
+	for k := range m {
 		if strings.HasSuffix(host, k) {
 			return true
 		}
@@ -83,11 +113,15 @@ func hostAllowed(host string) bool {
 func hostRewriteDetailed(host string) *HostRewrite {
 	result := &HostRewrite{Host: host}
 
-	if len(hostsMap) == 0 {
+	hostsMap.RLock()
+	m := hostsMap.m
+	hostsMap.RUnlock()
+
+	if len(m) == 0 {
 		return result
 	}
 
-	for k, v := range hostsMap {
+	for k, v := range m {
 		if strings.HasSuffix(host, k) {
 			// Check if replacement value is a full URL
 			if strings.Contains(v, "://") {
@@ -18,7 +18,7 @@ func init() {
 
 func TestHostsCSV(t *testing.T) {
 	// Reset the map for clean testing
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	
 	assert.NoError(t, hostsSetup(""))
 	assert.Equal(t, "test1.com", hostRewrite("test1.com"))
@@ -32,7 +32,7 @@ func TestHostsCSV(t *testing.T) {
 
 func TestHostsURL(t *testing.T) {
 	// Reset the map for clean testing
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	
 	// Test with no URL
 	*hostsURL = ""
@@ -53,12 +53,12 @@ func TestHostsURL(t *testing.T) {
 	
 	// Reset for other tests
 	*hostsURL = ""
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 }
 
 func TestHostsOnly(t *testing.T) {
 	// Reset the map and flags for clean testing
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	prevHostsOnly := *hostsOnly
 	
 	// Test when hosts-only is false (default)
@@ -84,18 +84,18 @@ func TestHostsOnly(t *testing.T) {
 	assert.False(t, hostAllowed("random.example.com"))
 	
 	// Test when hosts-only is true but no mappings exist
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	*hostsOnly = true
 	assert.False(t, hostAllowed("any-host.com"))
 	
 	// Restore original state
 	*hostsOnly = prevHostsOnly
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 }
 
 func TestHostRewriteDetailed(t *testing.T) {
 	// Reset the map for clean testing
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	
 	// Test basic host rewriting (backward compatibility)
 	assert.NoError(t, hostsSetup("old-api.example.com=new-api.example.com"))
@@ -107,7 +107,7 @@ func TestHostRewriteDetailed(t *testing.T) {
 	assert.Equal(t, "", result.FullURL)
 	
 	// Test URL with protocol
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	assert.NoError(t, hostsSetup("legacy.corp=https://modern.corp.example.com"))
 	
 	result = hostRewriteDetailed("legacy.corp")
@@ -117,7 +117,7 @@ func TestHostRewriteDetailed(t *testing.T) {
 	assert.Equal(t, "https://modern.corp.example.com", result.FullURL)
 	
 	// Test URL with protocol and port
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	assert.NoError(t, hostsSetup("internal.api=http://new-internal.api:8080"))
 	
 	result = hostRewriteDetailed("internal.api")
@@ -127,7 +127,7 @@ func TestHostRewriteDetailed(t *testing.T) {
 	assert.Equal(t, "http://new-internal.api:8080", result.FullURL)
 	
 	// Test HTTPS with non-standard port
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	assert.NoError(t, hostsSetup("secure.app=https://new-secure.app:9443"))
 	
 	result = hostRewriteDetailed("secure.app")
@@ -137,7 +137,7 @@ func TestHostRewriteDetailed(t *testing.T) {
 	assert.Equal(t, "https://new-secure.app:9443", result.FullURL)
 	
 	// Test subdomain matching with URL replacement
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	assert.NoError(t, hostsSetup("api.legacy.com=https://api.modern.com:8443"))
 	
 	result = hostRewriteDetailed("service.api.legacy.com")
@@ -154,29 +154,29 @@ func TestHostRewriteDetailed(t *testing.T) {
 	assert.Equal(t, "", result.FullURL)
 	
 	// Reset for other tests
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 }
 
 func TestBackwardCompatibility(t *testing.T) {
 	// Reset the map for clean testing
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	
 	// Test that hostRewrite still works the same way for simple host mappings
 	assert.NoError(t, hostsSetup("old.example.com=new.example.com"))
 	assert.Equal(t, "new.example.com", hostRewrite("old.example.com"))
 	
 	// Test that hostRewrite returns just the host part for URL mappings
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	assert.NoError(t, hostsSetup("old.example.com=https://new.example.com:8080"))
 	assert.Equal(t, "new.example.com", hostRewrite("old.example.com"))
 	
 	// Reset for other tests
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 }
 
 func TestProxyIntegration(t *testing.T) {
 	// Reset the map for clean testing
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 	
 	// Test WebSocket URL conversion
 	assert.NoError(t, hostsSetup("ws.example.com=https://ws.backend.com:8443"))
@@ -199,5 +199,5 @@ func TestProxyIntegration(t *testing.T) {
 	assert.Equal(t, "http://api.backend.com:8080", rewrite.FullURL)
 	
 	// Reset for other tests
-	hostsMap = map[string]string{}
+	hostsMap.m = map[string]string{}
 }
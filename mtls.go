@@ -0,0 +1,97 @@
+package beyond
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var (
+	clientCA     = flag.String("tls-client-ca", "", "CA bundle for verifying TLS client certificates (blank disables)")
+	clientMapURL = flag.String("tls-client-map-url", "", "URL or file of client certificate identity to user config (eg. https://github.com/myorg/beyond-config/main/raw/certs.json)")
+
+	clientMap = concurrentMapString{m: map[string]string{}}
+)
+
+// ServerTLSConfig returns the TLS listener config, requesting client
+// certificates when -tls-client-ca is set. Clients without one use SSO.
+func ServerTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *clientCA == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(*clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates in tls-client-ca: " + *clientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+func refreshClientMap() error {
+	if *clientMapURL == "" {
+		return nil
+	}
+
+	body, err := configOpen(*clientMapURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	m := map[string]string{}
+	err = json.NewDecoder(body).Decode(&m)
+	if err != nil {
+		return err
+	}
+	for k, v := range m {
+		if k == "" || v == "" {
+			return fmt.Errorf("invalid client certificate mapping: %q=%q", k, v)
+		}
+	}
+
+	clientMap.Lock()
+	clientMap.m = m
+	clientMap.Unlock()
+	return nil
+}
+
+// clientCertUser maps a verified client certificate to its user by SAN
+// email, SAN URI or CN. Mapped identities are translated, others pass through.
+func clientCertUser(r *http.Request) string {
+	if *clientCA == "" || r.TLS == nil || len(r.TLS.VerifiedChains) < 1 || len(r.TLS.VerifiedChains[0]) < 1 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	ids := append([]string{}, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	if len(ids) < 1 {
+		return ""
+	}
+
+	clientMap.RLock()
+	m := clientMap.m
+	clientMap.RUnlock()
+	for _, id := range ids {
+		if user, ok := m[id]; ok {
+			return user
+		}
+	}
+	return ids[0]
+}
@@ -0,0 +1,102 @@
+package beyond
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mtlsTestCerts(t *testing.T) (*x509.Certificate, *x509.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "MyOrg Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	spiffe, _ := url.Parse("spiffe://myorg.net/ci")
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ci-runner"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{spiffe},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(leafDER)
+	assert.NoError(t, err)
+
+	*clientCA = filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(*clientCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600))
+	return ca, leaf
+}
+
+func TestMTLS(t *testing.T) {
+	prevCA, prevMap := *clientCA, *clientMapURL
+	defer func() {
+		*clientCA, *clientMapURL = prevCA, prevMap
+		clientMap.m = map[string]string{}
+	}()
+
+	config, err := ServerTLSConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, config.ClientCAs)
+
+	ca, leaf := mtlsTestCerts(t)
+	config, err = ServerTLSConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, config.ClientAuth)
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: config.ClientCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.NoError(t, err)
+
+	request := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, "", clientCertUser(request))
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	assert.Equal(t, "", clientCertUser(request))
+	request.TLS.VerifiedChains = [][]*x509.Certificate{{leaf, ca}}
+	assert.Equal(t, "spiffe://myorg.net/ci", clientCertUser(request))
+
+	path := filepath.Join(t.TempDir(), "certs.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"ci-runner": "vendor@gmail.com"}`), 0600))
+	*clientMapURL = path
+	assert.NoError(t, refreshClientMap())
+	assert.Equal(t, "vendor@gmail.com", clientCertUser(request))
+
+	// the mapped user is fenced like any other
+	request.Host = "github.com"
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"ci-runner": ""}`), 0600))
+	assert.EqualError(t, refreshClientMap(), `invalid client certificate mapping: "ci-runner"=""`)
+
+	*clientCA = path
+	_, err = ServerTLSConfig()
+	assert.EqualError(t, err, "no certificates in tls-client-ca: "+path)
+}
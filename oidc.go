@@ -2,10 +2,16 @@ package beyond
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
 	oidc "github.com/coreos/go-oidc"
+	"github.com/dghubble/sessions"
+	cache "github.com/patrickmn/go-cache"
 	"golang.org/x/oauth2"
 )
 
@@ -13,20 +19,38 @@ var (
 	oidcIssuer       = flag.String("oidc-issuer", "https://accounts.google.com", "OIDC issuer URL provided by IdP")
 	oidcClientID     = flag.String("oidc-client-id", "f8b8b020-4ec2-0135-6452-027de1ec0c4e43491", "OIDC client ID")
 	oidcClientSecret = flag.String("oidc-client-secret", "cxLF74XOeRRFDJbKuJpZAOtL4pVPK1t2XGVrDbe5R", "OIDC client secret")
+	oidcGroupsClaim  = flag.String("oidc-groups-claim", "groups", "OIDC claim to map group membership from (blank disables)")
+	oidcPKCE         = flag.Bool("oidc-pkce", true, "send an S256 PKCE code challenge with OIDC logins")
+	oidcRefreshEvery = flag.Duration("oidc-refresh-interval", 0, "re-validate sessions with the IdP refresh token on this interval (0 disables)")
 
-	oidcConfig   oidcConfigI
-	oidcVerifier oidcVerifierI
+	oidcConfig     oidcConfigI
+	oidcVerifier   oidcVerifierI
+	oidcEndSession string
 
 	getOIDCClaims = parseClaims
+
+	oidcRefreshMu    sync.Mutex
+	oidcRefreshCalls = cache.New(time.Minute, 10*time.Minute)
 )
 
 type oidcClaims struct {
-	Email string `json:"email"`
+	Email  string   `json:"email"`
+	Groups []string `json:"-"`
+	Nonce  string   `json:"nonce"`
+
+	AuthTime int64 `json:"auth_time"`
+
+	// some IdPs send email_verified as a string
+	EmailVerified interface{} `json:"email_verified"`
+	HostedDomain  string      `json:"hd"`
+
+	RefreshToken string `json:"-"`
 }
 
 type oidcConfigI interface {
 	AuthCodeURL(string, ...oauth2.AuthCodeOption) string
-	Exchange(context.Context, string) (*oauth2.Token, error)
+	Exchange(context.Context, string, ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+	TokenSource(context.Context, *oauth2.Token) oauth2.TokenSource
 }
 
 type oauth2ConfigWrapper struct {
@@ -37,8 +61,8 @@ func (w *oauth2ConfigWrapper) AuthCodeURL(state string, opts ...oauth2.AuthCodeO
 	return w.Config.AuthCodeURL(state, opts...)
 }
 
-func (w *oauth2ConfigWrapper) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	return w.Config.Exchange(ctx, code)
+func (w *oauth2ConfigWrapper) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return w.Config.Exchange(ctx, code, opts...)
 }
 
 type oidcVerifierI interface {
@@ -46,16 +70,26 @@ type oidcVerifierI interface {
 }
 
 func oidcSetup(issuer string) error {
+	p := &oidcProvider{Issuer: issuer, ClientID: *oidcClientID, ClientSecret: *oidcClientSecret}
+	err := p.setup()
+	if err != nil {
+		return err
+	}
+	oidcConfig, oidcVerifier, oidcEndSession = p.config, p.verifier, p.endSession
+	return nil
+}
+
+func (p *oidcProvider) setup() error {
 	ctx := context.Background()
-	provider, err := oidc.NewProvider(ctx, issuer)
+	provider, err := oidc.NewProvider(ctx, p.Issuer)
 	if err != nil {
 		return err
 	}
 
 	// Configure an OpenID Connect aware OAuth2 client.
 	oauth2Config := &oauth2.Config{
-		ClientID:     *oidcClientID,
-		ClientSecret: *oidcClientSecret,
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
 		RedirectURL:  "https://" + *host + "/oidc",
 
 		// Discovery returns the OAuth2 endpoints.
@@ -65,44 +99,204 @@ func oidcSetup(issuer string) error {
 		Scopes: []string{oidc.ScopeOpenID, "profile", "email"},
 	}
 
-	oidcVerifier = provider.Verifier(&oidc.Config{
+	// RP-initiated logout is optional in discovery
+	discovery := struct {
+		EndSession string `json:"end_session_endpoint"`
+	}{}
+	err = provider.Claims(&discovery)
+	if err != nil {
+		return err
+	}
+
+	p.config = &oauth2ConfigWrapper{oauth2Config}
+	p.verifier = provider.Verifier(&oidc.Config{
 		ClientID: oauth2Config.ClientID,
 	})
-	oidcConfig = &oauth2ConfigWrapper{oauth2Config}
+	p.endSession = discovery.EndSession
 	return nil
 }
 
-func oidcVerify(code string) (string, error) {
+// oidcAuthCodeURL starts a login, saving the nonce and PKCE verifier in the session
+func oidcAuthCodeURL(p *oidcProvider, session *sessions.Session, state string, opts ...oauth2.AuthCodeOption) string {
+	nonce, _ := randhex32()
+	session.Values["provider"] = p.ID
+	session.Values["nonce"] = nonce
+	opts = append(opts, oauth2.AccessTypeOffline, oidc.Nonce(nonce))
+	if *oidcHD != "" && p.ID == oidcDefaultID {
+		opts = append(opts, oauth2.SetAuthURLParam("hd", *oidcHD))
+	}
+	if *oidcPKCE {
+		verifier := oauth2.GenerateVerifier()
+		session.Values["verifier"] = verifier
+		opts = append(opts, oauth2.S256ChallengeOption(verifier))
+	}
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func oidcVerify(p *oidcProvider, code string, session *sessions.Session) (*oidcClaims, error) {
+	nonce, _ := session.Values["nonce"].(string)
+	if nonce == "" {
+		return nil, fmt.Errorf("missing nonce")
+	}
+	var opts []oauth2.AuthCodeOption
+	if verifier, _ := session.Values["verifier"].(string); verifier != "" {
+		opts = append(opts, oauth2.VerifierOption(verifier))
+	}
+
 	ctx := context.Background()
-	token, err := oidcConfig.Exchange(ctx, code)
+	token, err := p.config.Exchange(ctx, code, opts...)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return oidcVerifyToken(ctx, token)
+	claims, err := p.verifyToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	return claims, nil
 }
 
-func oidcVerifyToken(ctx context.Context, token *oauth2.Token) (string, error) {
+// oidcRefresh re-validates the session user with the IdP at most once per
+// -oidc-refresh-interval. It returns false when the IdP rejects the refresh.
+func oidcRefresh(w http.ResponseWriter, session *sessions.Session) bool {
+	refresh, _ := session.Values["refresh"].(string)
+	if *oidcRefreshEvery <= 0 || refresh == "" {
+		return true
+	}
+	refreshed, _ := session.Values["refreshed"].(int64)
+	if time.Since(time.Unix(refreshed, 0)) < *oidcRefreshEvery {
+		return true
+	}
+	id, _ := session.Values["provider"].(string)
+	p := oidcProviderGet(id)
+	if p == nil {
+		return false
+	}
+
+	ctx := context.Background()
+	token, err := oidcRefreshToken(ctx, p, refresh)
+	if err != nil {
+		var rerr *oauth2.RetrieveError
+		if errors.As(err, &rerr) {
+			return false
+		}
+		// IdP unavailable, retry on the next request
+		Error(err)
+		return true
+	}
+	if _, ok := token.Extra("id_token").(string); ok {
+		claims, err := p.verifyToken(ctx, token)
+		if err != nil {
+			return false
+		}
+		// the session user is normalized, and the identity rules still apply
+		user, err := oidcIdentity(p, claims)
+		if err != nil || user != session.Values["user"] {
+			return false
+		}
+		session.Values["groups"] = claims.Groups
+	}
+	if token.RefreshToken != "" {
+		session.Values["refresh"] = token.RefreshToken
+	}
+	session.Values["refreshed"] = time.Now().Unix()
+	session.Save(w)
+	return true
+}
+
+// oidcRefreshCall is a refresh token redemption shared by concurrent requests
+type oidcRefreshCall struct {
+	done  chan struct{}
+	token *oauth2.Token
+	err   error
+}
+
+// oidcRefreshToken redeems each refresh token once and shares the result
+// with every request that still carries it, since IdPs that rotate refresh
+// tokens treat a second redemption as reuse and revoke the session
+func oidcRefreshToken(ctx context.Context, p *oidcProvider, refresh string) (*oauth2.Token, error) {
+	key := p.ID + " " + refresh
+	oidcRefreshMu.Lock()
+	v, shared := oidcRefreshCalls.Get(key)
+	if !shared {
+		v = &oidcRefreshCall{done: make(chan struct{})}
+		oidcRefreshCalls.SetDefault(key, v)
+	}
+	oidcRefreshMu.Unlock()
+
+	call := v.(*oidcRefreshCall)
+	if shared {
+		<-call.done
+		return call.token, call.err
+	}
+	call.token, call.err = p.config.TokenSource(ctx, &oauth2.Token{RefreshToken: refresh}).Token()
+	var rerr *oauth2.RetrieveError
+	if call.err != nil && !errors.As(call.err, &rerr) {
+		// IdP unavailable, let the next request retry
+		oidcRefreshCalls.Delete(key)
+	}
+	close(call.done)
+	return call.token, call.err
+}
+
+func (p *oidcProvider) verifyToken(ctx context.Context, token *oauth2.Token) (*oidcClaims, error) {
 	rawID, ok := token.Extra("id_token").(string)
 	if !ok {
-		return "", fmt.Errorf("missing ID token")
+		return nil, fmt.Errorf("missing ID token")
+	}
+	claims, err := p.verifyTokenID(ctx, rawID)
+	if err != nil {
+		return nil, err
 	}
-	return oidcVerifyTokenID(ctx, rawID)
+	claims.RefreshToken = token.RefreshToken
+	return claims, nil
 }
 
-func oidcVerifyTokenID(ctx context.Context, rawID string) (string, error) {
+func (p *oidcProvider) verifyTokenID(ctx context.Context, rawID string) (*oidcClaims, error) {
 	var err error
-	tokenID, err := oidcVerifier.Verify(ctx, rawID)
+	tokenID, err := p.verifier.Verify(ctx, rawID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	claims := new(oidcClaims)
 	err = getOIDCClaims(claims, tokenID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return claims.Email, nil
+	return claims, nil
 }
 
 func parseClaims(claims *oidcClaims, tokenID *oidc.IDToken) error {
-	return tokenID.Claims(claims)
+	err := tokenID.Claims(claims)
+	if err != nil || *oidcGroupsClaim == "" {
+		return err
+	}
+	raw := map[string]interface{}{}
+	err = tokenID.Claims(&raw)
+	if err != nil {
+		return err
+	}
+	claims.Groups = claimStrings(raw[*oidcGroupsClaim])
+	return nil
+}
+
+// claimStrings accepts a list or a single string from a decoded claim
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		var list []string
+		for _, elt := range v {
+			if elt, ok := elt.(string); ok && elt != "" {
+				list = append(list, elt)
+			}
+		}
+		return list
+	}
+	return nil
 }
@@ -7,7 +7,10 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -58,7 +61,7 @@ func (o *oidcMock) AuthCodeURL(state string, opt ...oauth2.AuthCodeOption) strin
 	return oidcServer.URL + "/AuthCodeURL"
 }
 
-func (o *oidcMock) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+func (o *oidcMock) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	token := &oauth2.Token{}
 	token.AccessToken = "AccessToken"
 	token.Expiry = time.Now().Add(time.Hour)
@@ -66,6 +69,31 @@ func (o *oidcMock) Exchange(ctx context.Context, code string) (*oauth2.Token, er
 	return token, nil
 }
 
+func (o *oidcMock) TokenSource(ctx context.Context, token *oauth2.Token) oauth2.TokenSource {
+	return oidcMockTokenSource(token.RefreshToken)
+}
+
+type oidcMockTokenSource string
+
+var oidcMockRefreshes int32
+
+// oidcMockAuthTime is the auth_time claim of mock ID tokens
+var oidcMockAuthTime int64
+
+func (s oidcMockTokenSource) Token() (*oauth2.Token, error) {
+	atomic.AddInt32(&oidcMockRefreshes, 1)
+	switch s {
+	case "slow":
+		time.Sleep(50 * time.Millisecond)
+	case "revoked":
+		return nil, &oauth2.RetrieveError{Response: &http.Response{StatusCode: 400}, ErrorCode: "invalid_grant"}
+	case "offline":
+		return nil, fmt.Errorf("dial tcp: connection refused")
+	}
+	token := &oauth2.Token{AccessToken: "AccessToken", RefreshToken: string(s) + "2"}
+	return token.WithExtra(map[string]interface{}{"id_token": "IDToken"}), nil
+}
+
 func (o *oidcMock) Verify(ctx context.Context, raw string) (*oidc.IDToken, error) {
 	if raw == "err" {
 		return nil, http.ErrHijacked
@@ -74,6 +102,9 @@ func (o *oidcMock) Verify(ctx context.Context, raw string) (*oidc.IDToken, error
 
 	getOIDCClaims = func(claims *oidcClaims, tokenID *oidc.IDToken) error {
 		claims.Email = "user3@domain3.com"
+		claims.Groups = []string{"staff"}
+		claims.Nonce = "nonce1"
+		claims.AuthTime = oidcMockAuthTime
 		return nil
 	}
 	if raw == "claimsErr" {
@@ -104,7 +135,7 @@ func TestOIDCSuccess(t *testing.T) {
 	// Test OIDC callback with state and next parameters
 	request := httptest.NewRequest("GET", "/oidc?state=barbaz&next=localhost/next", nil)
 	
-	vals := map[string]interface{}{"state": "barbaz", "next": oidcServer.URL + "/next"}
+	vals := map[string]interface{}{"state": "barbaz", "nonce": "nonce1", "next": oidcServer.URL + "/next"}
 	cookieValue, err := securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
 	assert.NoError(t, err)
 	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookieValue})
@@ -134,24 +165,180 @@ func TestOIDCSuccess(t *testing.T) {
 	assert.Equal(t, "NEXT", string(respBody))
 }
 
+func TestOIDCAuthCodeURL(t *testing.T) {
+	prev := oidcConfig
+	defer func() { oidcConfig = prev }()
+	oidcConfig = &oauth2ConfigWrapper{&oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: oidcServer.URL + "/authorize"},
+	}}
+
+	session := store.New(*cookieName)
+	u, err := url.Parse(oidcAuthCodeURL(oidcDefault(), session, "state1"))
+	assert.NoError(t, err)
+	assert.Equal(t, oidcDefaultID, session.Values["provider"])
+	assert.Equal(t, "state1", u.Query().Get("state"))
+	assert.Equal(t, "offline", u.Query().Get("access_type"))
+	assert.Equal(t, session.Values["nonce"], u.Query().Get("nonce"))
+	assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+	assert.Equal(t, oauth2.S256ChallengeFromVerifier(session.Values["verifier"].(string)), u.Query().Get("code_challenge"))
+}
+
+func TestOIDCVerifyNonce(t *testing.T) {
+	mock := &oidcMock{}
+	oidcConfig = mock
+	oidcVerifier = mock
+
+	session := store.New(*cookieName)
+	claims, err := oidcVerify(oidcDefault(), "code", session)
+	assert.Nil(t, claims)
+	assert.EqualError(t, err, "missing nonce")
+
+	session.Values["nonce"] = "replayed"
+	claims, err = oidcVerify(oidcDefault(), "code", session)
+	assert.Nil(t, claims)
+	assert.EqualError(t, err, "invalid nonce")
+
+	session.Values["nonce"] = "nonce1"
+	session.Values["verifier"] = oauth2.GenerateVerifier()
+	claims, err = oidcVerify(oidcDefault(), "code", session)
+	assert.NoError(t, err)
+	assert.Equal(t, "user3@domain3.com", claims.Email)
+}
+
 func TestOIDCVerifyToken(t *testing.T) {
 	token := &oauth2.Token{}
-	s, err := oidcVerifyToken(context.TODO(), token)
-	assert.Empty(t, s)
+	claims, err := oidcDefault().verifyToken(context.TODO(), token)
+	assert.Nil(t, claims)
 	assert.Equal(t, "missing ID token", err.Error())
 }
 
 func TestOIDCVerifyTokenID(t *testing.T) {
-	email, err := oidcVerifyTokenID(context.TODO(), "err")
-	assert.Equal(t, "", email)
+	claims, err := oidcDefault().verifyTokenID(context.TODO(), "err")
+	assert.Nil(t, claims)
 	assert.Equal(t, http.ErrHijacked, err)
 
 	testErr := fmt.Errorf("test error")
-	email, err = oidcVerifyTokenID(context.TODO(), "claimsErr")
-	assert.Equal(t, "", email)
+	claims, err = oidcDefault().verifyTokenID(context.TODO(), "claimsErr")
+	assert.Nil(t, claims)
 	assert.Equal(t, testErr, err)
 
-	email, err = oidcVerifyTokenID(context.TODO(), "rawID")
-	assert.Equal(t, "user3@domain3.com", email)
+	claims, err = oidcDefault().verifyTokenID(context.TODO(), "rawID")
+	assert.Equal(t, "user3@domain3.com", claims.Email)
+	assert.Equal(t, []string{"staff"}, claims.Groups)
 	assert.NoError(t, err)
 }
+
+func TestOIDCClaimStrings(t *testing.T) {
+	assert.Nil(t, claimStrings(nil))
+	assert.Nil(t, claimStrings(""))
+	assert.Nil(t, claimStrings(42))
+	assert.Equal(t, []string{"admins"}, claimStrings("admins"))
+	assert.Equal(t, []string{"admins", "staff"}, claimStrings([]interface{}{"admins", 7, "", "staff"}))
+}
+
+func TestOIDCRefresh(t *testing.T) {
+	mock := &oidcMock{}
+	oidcConfig = mock
+	oidcVerifier = mock
+
+	prev := *oidcRefreshEvery
+	defer func() { *oidcRefreshEvery = prev }()
+	*oidcRefreshEvery = time.Minute
+
+	session := store.New(*cookieName)
+	session.Values["user"] = "user3@domain3.com"
+	session.Values["refresh"] = "valid"
+	session.Values["refreshed"] = time.Now().Unix()
+	assert.True(t, oidcRefresh(httptest.NewRecorder(), session))
+	assert.Equal(t, "valid", session.Values["refresh"])
+
+	session.Values["refreshed"] = time.Now().Add(-time.Hour).Unix()
+	assert.True(t, oidcRefresh(httptest.NewRecorder(), session))
+	assert.Equal(t, "valid2", session.Values["refresh"])
+	assert.Equal(t, []string{"staff"}, session.Values["groups"])
+
+	session.Values["refresh"] = "offline"
+	session.Values["refreshed"] = int64(0)
+	assert.True(t, oidcRefresh(httptest.NewRecorder(), session))
+
+	session.Values["user"] = "other@domain3.com"
+	session.Values["refresh"] = "valid"
+	assert.False(t, oidcRefresh(httptest.NewRecorder(), session))
+
+	// the session user is compared after normalization
+	*userLowercase = true
+	session.Values["user"] = "user3@domain3.com"
+	session.Values["refresh"] = "valid"
+	session.Values["refreshed"] = int64(0)
+	userAliases.m = map[string]string{"user3@domain3.com": "user3@myorg.net"}
+	assert.False(t, oidcRefresh(httptest.NewRecorder(), session))
+	session.Values["user"] = "user3@myorg.net"
+	assert.True(t, oidcRefresh(httptest.NewRecorder(), session))
+	userAliases.m = map[string]string{}
+	*userLowercase = false
+
+	// and the identity rules are checked again
+	*userDomains = "myorg.net"
+	session.Values["user"] = "user3@domain3.com"
+	session.Values["refreshed"] = int64(0)
+	assert.False(t, oidcRefresh(httptest.NewRecorder(), session))
+	*userDomains = ""
+
+	// revoked sessions must login again
+	session.Values["user"] = "user3@domain3.com"
+	session.Values["refresh"] = "revoked"
+	assert.False(t, oidcRefresh(httptest.NewRecorder(), session))
+
+	recorder := httptest.NewRecorder()
+	assert.NoError(t, store.Save(recorder, session))
+	request := httptest.NewRequest("GET", "/test", nil)
+	request.Host = "github.com"
+	request.Header.Set("Cookie", strings.Split(recorder.Header().Get("Set-Cookie"), ";")[0])
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+
+	resp := w.Result()
+	assert.Equal(t, *fouroOneCode, resp.StatusCode)
+	assert.NotEqual(t, "", resp.Header.Get("Set-Cookie"))
+}
+
+func TestOIDCRefreshConcurrent(t *testing.T) {
+	mock := &oidcMock{}
+	oidcConfig = mock
+	oidcVerifier = mock
+
+	prev := *oidcRefreshEvery
+	defer func() { *oidcRefreshEvery = prev }()
+	*oidcRefreshEvery = time.Minute
+
+	// every request on the session redeems the refresh token only once
+	atomic.StoreInt32(&oidcMockRefreshes, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := oidcRefreshToken(context.TODO(), oidcDefault(), "slow")
+			assert.NoError(t, err)
+			assert.Equal(t, "slow2", token.RefreshToken)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&oidcMockRefreshes))
+
+	// later requests that still carry the old token get the same result
+	session := store.New(*cookieName)
+	session.Values["user"] = "user3@domain3.com"
+	session.Values["refresh"] = "slow"
+	assert.True(t, oidcRefresh(httptest.NewRecorder(), session))
+	assert.Equal(t, "slow2", session.Values["refresh"])
+	assert.Equal(t, int32(1), atomic.LoadInt32(&oidcMockRefreshes))
+
+	// unavailable IdPs are retried
+	session.Values["refresh"] = "offline"
+	session.Values["refreshed"] = int64(0)
+	assert.True(t, oidcRefresh(httptest.NewRecorder(), session))
+	assert.True(t, oidcRefresh(httptest.NewRecorder(), session))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&oidcMockRefreshes))
+}
@@ -0,0 +1,127 @@
+package beyond
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+)
+
+var (
+	federatePartiesURL = flag.String("federate-parties-url", "", "URL or file of federation relying parties config (eg. https://github.com/myorg/beyond-config/main/raw/parties.json)")
+
+	federateParties = concurrentMapParty{m: map[string]*federateParty{}}
+)
+
+// federateParty is a relying party with its own key for signing next URLs
+type federateParty struct {
+	ID        string   `json:"id"`
+	Key       string   `json:"key"`
+	Redirects []string `json:"redirects"`
+	Zone      string   `json:"zone"`
+
+	codecs []securecookie.Codec
+}
+
+type concurrentMapParty struct {
+	sync.RWMutex
+	m map[string]*federateParty
+}
+
+func refreshFederateParties() error {
+	if *federatePartiesURL == "" {
+		return nil
+	}
+
+	body, err := configOpen(*federatePartiesURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	list := []*federateParty{}
+	err = json.NewDecoder(body).Decode(&list)
+	if err != nil {
+		return err
+	}
+
+	m := map[string]*federateParty{}
+	for _, p := range list {
+		if p.ID == "" || len(p.Key) != 64 || len(p.Redirects) < 1 {
+			return fmt.Errorf("invalid relying party: %q", p.ID)
+		}
+		for _, prefix := range p.Redirects {
+			u, err := url.Parse(prefix)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("invalid redirect for relying party %q: %q", p.ID, prefix)
+			}
+		}
+		p.codecs = securecookie.CodecsFromPairs([]byte(p.Key)[0:31], []byte(p.Key)[32:64])
+		m[p.ID] = p
+	}
+
+	federateParties.Lock()
+	federateParties.m = m
+	federateParties.Unlock()
+	return nil
+}
+
+// federatePartyAuth decodes next with the relying party's key, or with
+// -federate-access when no party is named
+func federatePartyAuth(id string, next *string) (*federateParty, error) {
+	if id == "" {
+		return nil, securecookie.DecodeMulti("next", *next, next, federateAccessCodec...)
+	}
+
+	federateParties.RLock()
+	p := federateParties.m[id]
+	federateParties.RUnlock()
+	if p == nil {
+		return nil, errors.New("unknown relying party")
+	}
+	err := securecookie.DecodeMulti("next", *next, next, p.codecs...)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range p.Redirects {
+		if federateRedirectAllowed(*next, prefix) {
+			return p, nil
+		}
+	}
+	return nil, errors.New("redirect not allowed for relying party")
+}
+
+// federateRedirectAllowed matches the scheme and host of next exactly and
+// only prefix-matches the rest, so https://app.example.com does not allow
+// https://app.example.com.attacker.net
+func federateRedirectAllowed(next, prefix string) bool {
+	n, err := url.Parse(next)
+	if err != nil || n.User != nil || n.Host == "" {
+		return false
+	}
+	p, err := url.Parse(prefix)
+	if err != nil || n.Scheme != p.Scheme || !strings.EqualFold(n.Host, p.Host) {
+		return false
+	}
+	origin := len(n.Scheme + "://" + n.Host)
+	return strings.HasPrefix(next[origin:], prefix[len(p.Scheme+"://"+p.Host):])
+}
+
+// federateAllowed requires the relying party's zone, if any, to be granted
+// to the user or their groups, and otherwise fences its site like any other
+func federateAllowed(p *federateParty, next, user string, groups []string) bool {
+	principals := fencePrincipals(user, groups)
+	if p != nil && p.Zone != "" {
+		return fenceZones(principals...)[p.Zone]
+	}
+	u, err := url.Parse(next)
+	if err != nil {
+		return false
+	}
+	return !deny(&http.Request{Host: u.Host}, principals...)
+}
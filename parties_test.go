@@ -0,0 +1,89 @@
+package beyond
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func partiesTestRequest(t *testing.T, query string, user string, groups []string) *http.Response {
+	request := httptest.NewRequest("GET", "/federate?"+query, nil)
+	request.Host = *host
+	vals := map[string]interface{}{"user": user, "groups": groups}
+	cookieValue, err := securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
+	assert.NoError(t, err)
+	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookieValue})
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	return w.Result()
+}
+
+func TestFederateParties(t *testing.T) {
+	prev := *federatePartiesURL
+	defer func() {
+		*federatePartiesURL = prev
+		federateParties.m = map[string]*federateParty{}
+	}()
+	cwd, _ := os.Getwd()
+	*federatePartiesURL = cwd + "/example/parties.json"
+	assert.NoError(t, refreshFederateParties())
+	*federateSecretKey = "S6ZhSfYRwzXHTNa3ZJo7uFQ2qsWZ5u1Id9zcNzr9ObeWnNExMXYbeXxy9CxMMz6F"
+	assert.NoError(t, federateSetup())
+
+	wiki := federateParties.m["wiki"]
+	mirror := federateParties.m["git-mirror"]
+	wikiNext, err := securecookie.EncodeMulti("next", "https://wiki.partner.com/auth/callback?token=", wiki.codecs...)
+	assert.NoError(t, err)
+
+	resp := partiesTestRequest(t, "rp=wiki&next="+url.QueryEscape(wikiNext), "cloud@user.com", nil)
+	assert.Equal(t, 302, resp.StatusCode)
+
+	// a party cannot mint next URLs for another
+	resp = partiesTestRequest(t, "rp=git-mirror&next="+url.QueryEscape(wikiNext), "cloud@user.com", nil)
+	assert.Equal(t, 403, resp.StatusCode)
+	resp = partiesTestRequest(t, "rp=unknown&next="+url.QueryEscape(wikiNext), "cloud@user.com", nil)
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// nor redirect outside its prefixes
+	evilNext, err := securecookie.EncodeMulti("next", "https://evil.partner.com/?token=", wiki.codecs...)
+	assert.NoError(t, err)
+	resp = partiesTestRequest(t, "rp=wiki&next="+url.QueryEscape(evilNext), "cloud@user.com", nil)
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// fenced users only reach parties in their sites
+	resp = partiesTestRequest(t, "rp=wiki&next="+url.QueryEscape(wikiNext), "consultant@gmail.com", nil)
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// the zone must be granted to the user or a group
+	mirrorNext, err := securecookie.EncodeMulti("next", "https://mirror.partner.com/login?token=", mirror.codecs...)
+	assert.NoError(t, err)
+	resp = partiesTestRequest(t, "rp=git-mirror&next="+url.QueryEscape(mirrorNext), "cloud@user.com", nil)
+	assert.Equal(t, 403, resp.StatusCode)
+	resp = partiesTestRequest(t, "rp=git-mirror&next="+url.QueryEscape(mirrorNext), "consultant@gmail.com", nil)
+	assert.Equal(t, 302, resp.StatusCode)
+	resp = partiesTestRequest(t, "rp=git-mirror&next="+url.QueryEscape(mirrorNext), "cloud@user.com", []string{"contractors"})
+	assert.Equal(t, 302, resp.StatusCode)
+
+	path := filepath.Join(t.TempDir(), "parties.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"id": "short", "key": "abc", "redirects": ["https://x.com/"]}]`), 0600))
+	*federatePartiesURL = path
+	assert.EqualError(t, refreshFederateParties(), `invalid relying party: "short"`)
+}
+
+func TestFederateRedirectAllowed(t *testing.T) {
+	assert.True(t, federateRedirectAllowed("https://app.example.com/cb?token=", "https://app.example.com"))
+	assert.True(t, federateRedirectAllowed("https://App.Example.com/auth/cb", "https://app.example.com/auth/"))
+	assert.True(t, federateRedirectAllowed("https://mirror.partner.com/login?token=", "https://mirror.partner.com/login?token="))
+	assert.False(t, federateRedirectAllowed("https://app.example.com.attacker.net/", "https://app.example.com"))
+	assert.False(t, federateRedirectAllowed("https://app.example.com@attacker.net/", "https://app.example.com"))
+	assert.False(t, federateRedirectAllowed("https://app.example.com:8443/", "https://app.example.com"))
+	assert.False(t, federateRedirectAllowed("http://app.example.com/", "https://app.example.com"))
+	assert.False(t, federateRedirectAllowed("https://app.example.com/other", "https://app.example.com/auth/"))
+	assert.False(t, federateRedirectAllowed("//app.example.com/auth/", "https://app.example.com/auth/"))
+}
@@ -0,0 +1,172 @@
+package beyond
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	oidcName         = flag.String("oidc-name", "Single Sign-On", "display name of the -oidc-issuer provider on the chooser page")
+	oidcProvidersURL = flag.String("oidc-providers-url", "", "URL to additional OIDC providers config (eg. https://github.com/myorg/beyond-config/main/raw/providers.json)")
+
+	oidcProviders = []*oidcProvider{}
+
+	chooserTemplate = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta charset="utf-8" /><meta name="viewport" content="width=device-width, initial-scale=1" />
+		<title>Sign In</title>
+		<style type="text/css">body{background-color:#21232a;color:{{.color}};font-family:"Open Sans",Arial,sans-serif;text-align:center;padding-top:10%}a{display:block;width:20em;margin:1em auto;padding:.75em;color:#fff;text-decoration:none;border:1px solid #707070}a:hover{border-color:{{.color}}}</style>
+	</head>
+	<body>
+		<h1>Sign In</h1>
+		{{range .providers}}<a href="{{.URL}}">{{.Name}}</a>
+		{{end}}
+	</body>
+</html>`))
+)
+
+const oidcDefaultID = "default"
+
+// oidcProvider is one OIDC identity provider
+type oidcProvider struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Domain       string `json:"domain"`
+
+	config     oidcConfigI
+	verifier   oidcVerifierI
+	endSession string
+}
+
+func oidcDefault() *oidcProvider {
+	return &oidcProvider{
+		ID:       oidcDefaultID,
+		Name:     *oidcName,
+		Issuer:   *oidcIssuer,
+		ClientID: *oidcClientID,
+
+		config:     oidcConfig,
+		verifier:   oidcVerifier,
+		endSession: oidcEndSession,
+	}
+}
+
+func oidcProvidersSetup() error {
+	if *oidcProvidersURL == "" {
+		return nil
+	}
+
+	resp, err := httpACLGet(*oidcProvidersURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	list := []*oidcProvider{}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return err
+	}
+
+	ids := map[string]bool{oidcDefaultID: true}
+	for _, p := range list {
+		if p.ID == "" || ids[p.ID] {
+			return fmt.Errorf("invalid or duplicate OIDC provider id: %q", p.ID)
+		}
+		ids[p.ID] = true
+		if p.Name == "" {
+			p.Name = p.ID
+		}
+		if strings.TrimSpace(p.Domain) == "" {
+			return fmt.Errorf("OIDC provider %q requires a domain", p.ID)
+		}
+		err = p.setup()
+		if err != nil {
+			return fmt.Errorf("OIDC provider %q: %v", p.ID, err)
+		}
+	}
+	oidcProviders = list
+	return nil
+}
+
+func oidcProviderGet(id string) *oidcProvider {
+	if id == "" || id == oidcDefaultID {
+		return oidcDefault()
+	}
+	for _, p := range oidcProviders {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// oidcProviderChoose selects a provider by id or login hint, or nil for the chooser
+func oidcProviderChoose(r *http.Request) *oidcProvider {
+	if id := r.URL.Query().Get("provider"); id != "" {
+		return oidcProviderGet(id)
+	}
+	if len(oidcProviders) < 1 {
+		return oidcDefault()
+	}
+	hint := r.URL.Query().Get("login_hint")
+	if strings.Contains(hint, "@") {
+		for _, p := range oidcProviders {
+			if p.emailAllowed(hint) {
+				return p
+			}
+		}
+		return oidcDefault()
+	}
+	return nil
+}
+
+// emailAllowed keeps an additional provider to the emails of its own domain
+// CSV, so a partner IdP cannot log in users of another organization
+func (p *oidcProvider) emailAllowed(email string) bool {
+	if p.ID == oidcDefaultID {
+		return true
+	}
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	for _, d := range strings.Split(p.Domain, ",") {
+		if d = strings.TrimSpace(d); d != "" && strings.EqualFold(d, email[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func oidcChooser(w http.ResponseWriter, r *http.Request) {
+	type choice struct{ Name, URL string }
+
+	choices := []choice{}
+	for _, p := range append([]*oidcProvider{oidcDefault()}, oidcProviders...) {
+		v := url.Values{}
+		v.Set("provider", p.ID)
+		v.Set("next", r.URL.Query().Get("next"))
+		if maxAge := r.URL.Query().Get("max_age"); maxAge != "" {
+			v.Set("max_age", maxAge)
+		}
+		choices = append(choices, choice{p.Name, "/launch?" + v.Encode()})
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	err := chooserTemplate.Execute(w, map[string]interface{}{
+		"color":     *errorColor,
+		"providers": choices,
+	})
+	if err != nil {
+		Error(err)
+	}
+}
@@ -0,0 +1,131 @@
+package beyond
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	providersServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 "http://" + r.Host,
+				"authorization_endpoint": "http://" + r.Host + "/authorize",
+				"token_endpoint":         "http://" + r.Host + "/token",
+				"jwks_uri":               "http://" + r.Host + "/keys",
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+)
+
+func providersTestSetup(t *testing.T, config string) error {
+	f := filepath.Join(t.TempDir(), "providers.json")
+	assert.NoError(t, os.WriteFile(f, []byte(config), 0644))
+	*oidcProvidersURL = "file://" + f
+	return oidcProvidersSetup()
+}
+
+func TestProvidersSetup(t *testing.T) {
+	defer func() {
+		*oidcProvidersURL = ""
+		oidcProviders = []*oidcProvider{}
+	}()
+
+	assert.EqualError(t, providersTestSetup(t, `[{"id": "default"}]`), `invalid or duplicate OIDC provider id: "default"`)
+	assert.EqualError(t, providersTestSetup(t, `[{"id": "a", "issuer": "`+providersServer.URL+`", "domain": "a.com"}, {"id": "a"}]`), `invalid or duplicate OIDC provider id: "a"`)
+	assert.Contains(t, providersTestSetup(t, `[{"id": "a", "issuer": "ftp://localhost", "domain": "a.com"}]`).Error(), `OIDC provider "a"`)
+	assert.EqualError(t, providersTestSetup(t, `[{"id": "a", "issuer": "`+providersServer.URL+`"}]`), `OIDC provider "a" requires a domain`)
+
+	assert.NoError(t, providersTestSetup(t, `[
+		{"id": "okta", "name": "Partners", "issuer": "`+providersServer.URL+`", "client_id": "partner-client", "domain": "partner.com"},
+		{"id": "other", "issuer": "`+providersServer.URL+`", "client_id": "other-client", "domain": "other.com, other.io"}
+	]`))
+	assert.Len(t, oidcProviders, 2)
+	assert.Equal(t, "other", oidcProviderGet("other").Name)
+	assert.Equal(t, oidcDefaultID, oidcProviderGet("").ID)
+	assert.Nil(t, oidcProviderGet("missing"))
+
+	r := httptest.NewRequest("GET", "/launch?login_hint=Bob@Partner.com", nil)
+	assert.Equal(t, "okta", oidcProviderChoose(r).ID)
+	r = httptest.NewRequest("GET", "/launch?login_hint=bob@myorg.net", nil)
+	assert.Equal(t, oidcDefaultID, oidcProviderChoose(r).ID)
+	r = httptest.NewRequest("GET", "/launch?login_hint=bob@other.io", nil)
+	assert.Equal(t, "other", oidcProviderChoose(r).ID)
+	r = httptest.NewRequest("GET", "/launch?provider=other", nil)
+	assert.Equal(t, "other", oidcProviderChoose(r).ID)
+	r = httptest.NewRequest("GET", "/launch", nil)
+	assert.Nil(t, oidcProviderChoose(r))
+
+	// chooser page
+	request := httptest.NewRequest("GET", "/launch?next=https%3A%2F%2Fgit.myorg.net%2F", nil)
+	request.Host = *host
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(body), "Partners")
+	assert.Contains(t, string(body), *oidcName)
+	assert.Contains(t, string(body), "/launch?next=https%3A%2F%2Fgit.myorg.net%2F&amp;provider=okta")
+
+	// login hint selects the partner IdP
+	request = httptest.NewRequest("GET", "/launch?login_hint=bob@partner.com&next=https%3A%2F%2Fgit.myorg.net%2F", nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	resp = w.Result()
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(body), providersServer.URL+"/authorize?")
+	assert.Contains(t, string(body), "client_id=partner-client")
+	assert.Contains(t, string(body), "login_hint=bob%40partner.com")
+
+	vals := map[string]interface{}{}
+	cookie := resp.Cookies()[0].Value
+	assert.NoError(t, securecookie.DecodeMulti(*cookieName, cookie, &vals, store.Codecs...))
+	assert.Equal(t, "okta", vals["provider"])
+
+	// callbacks are verified by the provider in the session
+	mock := &oidcMock{}
+	oidcProviders[0].config = mock
+	oidcProviders[0].verifier = mock
+	vals["nonce"] = "nonce1"
+	cookie, err := securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
+	assert.NoError(t, err)
+	request = httptest.NewRequest("GET", "/oidc?state="+vals["state"].(string), nil)
+	request.Host = *host
+	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookie})
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode, "partner IdPs cannot log in users outside their domain")
+
+	oidcProviders[0].Domain = "partner.com,domain3.com"
+	request = httptest.NewRequest("GET", "/oidc?state="+vals["state"].(string), nil)
+	request.Host = *host
+	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookie})
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 302, w.Result().StatusCode)
+	assert.Equal(t, "https://git.myorg.net/", w.Result().Header.Get("Location"))
+
+	vals["provider"] = "removed"
+	cookie, err = securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
+	assert.NoError(t, err)
+	request = httptest.NewRequest("GET", "/oidc?state="+vals["state"].(string), nil)
+	request.Host = *host
+	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookie})
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 400, w.Result().StatusCode)
+}
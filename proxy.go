@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/koding/websocketproxy"
@@ -114,9 +115,58 @@ func reproxy() error {
 	return lerr
 }
 
+// headerStrip removes client-supplied headers that backends may trust
+func headerStrip(h http.Header) {
+	prefix := http.CanonicalHeaderKey(*headerPrefix + "-")
+	for k := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), prefix) {
+			h.Del(k)
+		}
+	}
+	for _, k := range strings.Split(*headerStripCSV, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			h.Del(k)
+		}
+	}
+}
+
+// cookieStrip removes beyond's own session cookie, and any others configured,
+// so backends cannot replay them
+func cookieStrip(h http.Header) {
+	names := map[string]bool{*cookieName: true}
+	for _, name := range strings.Split(*cookieStripCSV, ",") {
+		names[strings.TrimSpace(name)] = true
+	}
+
+	kept := []string{}
+	for _, line := range h.Values("Cookie") {
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			name, _, _ := strings.Cut(part, "=")
+			if part != "" && !names[name] {
+				kept = append(kept, part)
+			}
+		}
+	}
+	h.Del("Cookie")
+	if len(kept) > 0 {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
 func websocketproxyDirector(incoming *http.Request, out http.Header) {
+	headerStrip(out)
+	cookieStrip(out)
 	out.Set("User-Agent", incoming.UserAgent())
 	out.Set("X-Forwarded-Proto", "https")
+
+	// handler has already stripped the client's own
+	prefix := http.CanonicalHeaderKey(*headerPrefix + "-")
+	for k, v := range incoming.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), prefix) {
+			out[http.CanonicalHeaderKey(k)] = v
+		}
+	}
 }
 
 func websocketproxyNew(r *http.Request) (*websocketproxy.WebsocketProxy, error) {
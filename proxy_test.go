@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
@@ -73,4 +74,78 @@ func TestWSPDirector(t *testing.T) {
 
 	assert.Equal(t, out.Get("User-Agent"), "User-Agent")
 	assert.Equal(t, out.Get("X-Forwarded-Proto"), "https")
+	assert.Equal(t, out.Get("Beyond-Assertion"), "")
+
+	incoming.Header.Set("Beyond-Assertion", "jwt")
+	incoming.Header.Set("Beyond-User", "cloud@user.com")
+	out.Set("beyond-user", "spoofed")
+	websocketproxyDirector(incoming, out)
+	assert.Equal(t, out.Get("Beyond-Assertion"), "jwt")
+	assert.Equal(t, []string{"cloud@user.com"}, out.Values("Beyond-User"))
+}
+
+func TestHeaderStrip(t *testing.T) {
+	*headerStripCSV = "X-Forwarded-User, X-Remote-User"
+	defer func() { *headerStripCSV = "" }()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Beyond-User") + r.Header.Get("Beyond-Groups") + r.Header.Get("X-Remote-User") + r.Header.Get("X-Other")))
+	}))
+	defer backend.Close()
+	backendHost := backend.URL[7:]
+	allowlist.Lock()
+	allowlist.m["host"][backendHost] = true
+	allowlist.Unlock()
+	defer func() {
+		allowlist.Lock()
+		delete(allowlist.m["host"], backendHost)
+		allowlist.Unlock()
+	}()
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = backendHost
+	request.Header.Set("Beyond-User", "admin@myorg.net")
+	request.Header.Set("beyond-groups", "admins")
+	request.Header.Set("X-Remote-User", "admin")
+	request.Header.Set("X-Other", "kept")
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, "kept", w.Body.String())
+}
+
+func TestCookieStrip(t *testing.T) {
+	*cookieStripCSV = "token"
+	defer func() { *cookieStripCSV = "" }()
+
+	h := http.Header{}
+	h.Add("Cookie", *cookieName+"=secret; app=1")
+	h.Add("Cookie", "token=saml;other=2")
+	cookieStrip(h)
+	assert.Equal(t, []string{"app=1; other=2"}, h.Values("Cookie"))
+
+	h = http.Header{"Cookie": []string{*cookieName + "=secret"}}
+	cookieStrip(h)
+	assert.Empty(t, h.Values("Cookie"))
+
+	// and on the way to a backend
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Cookie")))
+	}))
+	defer backend.Close()
+	vals := map[string]interface{}{"user": "cloud@user.com"}
+	cookieValue, err := securecookie.EncodeMulti(*cookieName, &vals, store.Codecs...)
+	assert.NoError(t, err)
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = backend.URL[7:]
+	request.AddCookie(&http.Cookie{Name: *cookieName, Value: cookieValue})
+	request.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, "app=1", w.Body.String())
+
+	out := http.Header{"Cookie": []string{*cookieName + "=secret; app=1"}}
+	websocketproxyDirector(request, out)
+	assert.Equal(t, "app=1", out.Get("Cookie"))
 }
@@ -0,0 +1,65 @@
+package beyond
+
+import (
+	"flag"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	nextHosts = flag.String("next-hosts", "", "CSV of hosts outside cookie-domain that users may return to after login")
+
+	redirectTemplate = template.Must(template.New("redirect").Parse(`<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta charset="utf-8" /><meta name="viewport" content="width=device-width, initial-scale=1" />
+		<title>Redirecting</title>
+		<script type="text/javascript">window.location.replace({{.}});</script>
+	</head>
+	<body>
+		<noscript><a href="{{.}}">Continue</a></noscript>
+	</body>
+</html>`))
+)
+
+// nextAllowed reports whether a post-login next URL is https and on
+// -beyond-host, under -cookie-domain or in -next-hosts
+func nextAllowed(next string) bool {
+	if strings.ContainsAny(next, "\\\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Host == "" {
+		return false
+	}
+	if u.Host == *host {
+		return true
+	}
+
+	h := strings.ToLower(u.Hostname())
+	domain := strings.ToLower(strings.TrimPrefix(*cookieDom, "."))
+	if domain != "" && (h == domain || strings.HasSuffix(h, "."+domain)) {
+		return true
+	}
+	for _, x := range strings.Split(*nextHosts, ",") {
+		if x = strings.TrimSpace(x); x != "" && strings.EqualFold(x, h) {
+			return true
+		}
+	}
+	return false
+}
+
+func jsRedirect(w http.ResponseWriter, next string) {
+	if w == nil {
+		return
+	}
+
+	// hack to guarantee interactive session
+	w.Header().Set("Content-Type", "text/html")
+	err := redirectTemplate.Execute(w, next)
+	if err != nil {
+		Error(err)
+	}
+}
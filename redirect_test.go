@@ -0,0 +1,43 @@
+package beyond
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectNext(t *testing.T) {
+	defer func() { *nextHosts = "" }()
+
+	assert.True(t, nextAllowed("https://"+*host+"/"))
+	assert.True(t, nextAllowed("https://git.myorg.net/a?b=c"))
+	assert.True(t, nextAllowed("https://MYORG.net:8443/"))
+	assert.False(t, nextAllowed("http://git.myorg.net/"))
+	assert.False(t, nextAllowed("https://evil.com/"))
+	assert.False(t, nextAllowed("https://evilmyorg.net/"))
+	assert.False(t, nextAllowed("https://git.myorg.net@evil.com/"))
+	assert.False(t, nextAllowed("https://evil.com\\@git.myorg.net/"))
+	assert.False(t, nextAllowed("//evil.com/"))
+	assert.False(t, nextAllowed("javascript:alert(1)"))
+
+	*nextHosts = "partner.com, wiki.partner.com"
+	assert.True(t, nextAllowed("https://wiki.partner.com/"))
+	assert.False(t, nextAllowed("https://other.partner.com/"))
+
+	request := httptest.NewRequest("GET", "/launch?next="+url.QueryEscape("https://evil.com/"), nil)
+	request.Host = *host
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 400, w.Code)
+	assert.Empty(t, w.Result().Cookies())
+}
+
+func TestRedirectEscaped(t *testing.T) {
+	w := httptest.NewRecorder()
+	jsRedirect(w, `https://git.myorg.net/");alert(1);//<a>`)
+	assert.NotContains(t, w.Body.String(), `<a>`)
+	assert.Contains(t, w.Body.String(), `window.location.replace("https://git.myorg.net/\");alert(1);//\u003ca\u003e");`)
+	assert.Contains(t, w.Body.String(), `<noscript><a href="https://git.myorg.net/%22%29;alert%281%29;//%3ca%3e">Continue</a></noscript>`)
+}
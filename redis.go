@@ -0,0 +1,252 @@
+package beyond
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisPoolIdle is the number of idle connections kept for reuse
+const redisPoolIdle = 16
+
+// redisSessions is a sessionBackend for redis-compatible servers. Each
+// command takes its own pooled connection, so one slow reply does not
+// stall other requests.
+type redisSessions struct {
+	addr     string
+	password string
+	db       string
+	prefix   string
+
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func newRedisSessions(addr string) (*redisSessions, error) {
+	r := &redisSessions{addr: addr, prefix: *cookieName + ":", idle: make(chan *redisConn, redisPoolIdle)}
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "redis" {
+			return nil, fmt.Errorf("invalid redis URL scheme: %q", u.Scheme)
+		}
+		r.addr = u.Host
+		r.password, _ = u.User.Password()
+		r.db = strings.TrimPrefix(u.Path, "/")
+	}
+	_, err := r.do("PING")
+	return r, err
+}
+
+func (r *redisSessions) Load(id string) (map[string]interface{}, error) {
+	v, err := r.do("GET", r.prefix+"sid:"+id)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	return sessionDecode(b)
+}
+
+func (r *redisSessions) Save(id, user string, values map[string]interface{}, ttl time.Duration) error {
+	data, err := sessionEncode(values)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		ttl = time.Duration(*cookieAge) * time.Second
+	}
+	sec := strconv.Itoa(int(ttl.Seconds()))
+	_, err = r.do("SET", r.prefix+"sid:"+id, string(data), "EX", sec)
+	if err != nil || user == "" {
+		return err
+	}
+	_, err = r.do("SADD", r.prefix+"user:"+user, id)
+	if err == nil {
+		_, err = r.do("EXPIRE", r.prefix+"user:"+user, sec)
+	}
+	return err
+}
+
+func (r *redisSessions) Delete(id string) error {
+	_, err := r.do("DEL", r.prefix+"sid:"+id)
+	return err
+}
+
+func (r *redisSessions) List(user string) ([]string, error) {
+	v, err := r.do("SMEMBERS", r.prefix+"user:"+user)
+	if err != nil {
+		return nil, err
+	}
+	members, _ := v.([]interface{})
+	ids := []string{}
+	for _, m := range members {
+		id, _ := m.([]byte)
+		exists, err := r.do("EXISTS", r.prefix+"sid:"+string(id))
+		if err != nil {
+			return nil, err
+		}
+		if exists == int64(1) {
+			ids = append(ids, string(id))
+		} else {
+			r.do("SREM", r.prefix+"user:"+user, string(id))
+		}
+	}
+	return ids, nil
+}
+
+func (r *redisSessions) Revoke(user string) error {
+	ids, err := r.List(user)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = r.Delete(id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = r.do("DEL", r.prefix+"user:"+user)
+	return err
+}
+
+// do sends one command on an idle connection, moving on to the next one
+// when an idle connection was lost and to a new one when none are left
+func (r *redisSessions) do(args ...string) (interface{}, error) {
+	for {
+		var (
+			c     *redisConn
+			err   error
+			fresh bool
+		)
+		select {
+		case c = <-r.idle:
+		default:
+			fresh = true
+			c, err = r.dial()
+			if err != nil {
+				return nil, err
+			}
+		}
+		v, err := c.roundtrip(args...)
+		if _, ok := err.(redisError); ok || err == nil {
+			r.release(c)
+			return v, err
+		}
+		c.Close()
+		if fresh {
+			return nil, err
+		}
+	}
+}
+
+// release returns a healthy connection to the pool, or closes it when the
+// pool is full
+func (r *redisSessions) release(c *redisConn) {
+	select {
+	case r.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+func (r *redisSessions) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn, bufio.NewReader(conn)}
+	if r.password != "" {
+		_, err = c.roundtrip("AUTH", r.password)
+	}
+	if err == nil && r.db != "" {
+		_, err = c.roundtrip("SELECT", r.db)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *redisConn) roundtrip(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(c, b.String())
+	if err != nil {
+		return nil, err
+	}
+	return redisRead(c.rd)
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisRead parses one RESP reply
+func redisRead(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) < 1 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(rd, b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i], err = redisRead(rd)
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply: %q", line)
+}
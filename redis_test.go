@@ -0,0 +1,177 @@
+package beyond
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// redisStandIn serves the handful of commands used by redisSessions
+type redisStandIn struct {
+	sync.Mutex
+	listener net.Listener
+	password string
+	strings  map[string]string
+	sets     map[string]map[string]bool
+}
+
+func newRedisStandIn(t *testing.T, password string) *redisStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &redisStandIn{listener: l, password: password, strings: map[string]string{}, sets: map[string]map[string]bool{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *redisStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		v, err := redisRead(rd)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range v.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		if len(args) > 1 && strings.HasSuffix(args[1], "sid:slow") {
+			time.Sleep(time.Second)
+		}
+		if !authed && args[0] != "AUTH" {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		s.Lock()
+		switch args[0] {
+		case "AUTH":
+			authed = args[1] == s.password
+			if authed {
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+		case "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		case "SELECT", "EXPIRE":
+			fmt.Fprint(conn, "+OK\r\n")
+		case "SET":
+			s.strings[args[1]] = args[2]
+			fmt.Fprint(conn, "+OK\r\n")
+		case "GET":
+			v, ok := s.strings[args[1]]
+			if ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case "EXISTS":
+			_, ok := s.strings[args[1]]
+			if ok {
+				fmt.Fprint(conn, ":1\r\n")
+			} else {
+				fmt.Fprint(conn, ":0\r\n")
+			}
+		case "DEL":
+			delete(s.strings, args[1])
+			delete(s.sets, args[1])
+			fmt.Fprint(conn, ":1\r\n")
+		case "SADD":
+			if s.sets[args[1]] == nil {
+				s.sets[args[1]] = map[string]bool{}
+			}
+			s.sets[args[1]][args[2]] = true
+			fmt.Fprint(conn, ":1\r\n")
+		case "SREM":
+			delete(s.sets[args[1]], args[2])
+			fmt.Fprint(conn, ":1\r\n")
+		case "SMEMBERS":
+			fmt.Fprintf(conn, "*%d\r\n", len(s.sets[args[1]]))
+			for m := range s.sets[args[1]] {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(m), m)
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		s.Unlock()
+	}
+}
+
+func TestRedisSessions(t *testing.T) {
+	standIn := newRedisStandIn(t, "secret")
+	defer standIn.listener.Close()
+
+	_, err := newRedisSessions("redis://" + standIn.listener.Addr().String())
+	assert.EqualError(t, err, "redis: NOAUTH Authentication required.")
+	_, err = newRedisSessions("http://" + standIn.listener.Addr().String())
+	assert.EqualError(t, err, `invalid redis URL scheme: "http"`)
+
+	r, err := newRedisSessions("redis://:secret@" + standIn.listener.Addr().String() + "/2")
+	assert.NoError(t, err)
+
+	values := map[string]interface{}{"user": "cloud@user.com", "groups": []string{"staff"}, "refreshed": int64(42)}
+	assert.NoError(t, r.Save("sid1", "cloud@user.com", values, time.Hour))
+	assert.NoError(t, r.Save("sid2", "cloud@user.com", values, time.Hour))
+	assert.NoError(t, r.Save("sid3", "", map[string]interface{}{"next": "https://git.myorg.net/"}, 0))
+
+	loaded, err := r.Load("sid1")
+	assert.NoError(t, err)
+	assert.Equal(t, values, loaded)
+	_, err = r.Load("missing")
+	assert.Equal(t, errSessionNotFound, err)
+
+	ids, err := r.List("cloud@user.com")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"sid1", "sid2"}, ids)
+
+	assert.NoError(t, r.Delete("sid1"))
+	ids, err = r.List("cloud@user.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sid2"}, ids)
+
+	assert.NoError(t, r.Revoke("cloud@user.com"))
+	_, err = r.Load("sid2")
+	assert.Equal(t, errSessionNotFound, err)
+	_, err = r.Load("sid3")
+	assert.NoError(t, err)
+
+	// reconnects after connections drop
+	for i := len(r.idle); i > 0; i-- {
+		c := <-r.idle
+		c.Close()
+		r.idle <- c
+	}
+	_, err = r.Load("sid3")
+	assert.NoError(t, err)
+
+	// a slow reply does not hold up other commands
+	slow := make(chan error)
+	go func() {
+		_, err := r.Load("slow")
+		slow <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	_, err = r.Load("sid3")
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, errSessionNotFound, <-slow)
+
+	_, err = r.do("FLUSHALL")
+	assert.True(t, strings.HasPrefix(err.Error(), "redis: ERR unknown command"))
+}
@@ -0,0 +1,74 @@
+package beyond
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	refreshInterval = flag.Duration("refresh-interval", 0, "reload fence, sites, allowlist, hosts and the other config URLs and files on this interval (0 disables)")
+
+	refreshMu   sync.Mutex
+	refreshStop chan struct{}
+)
+
+// refreshAll reloads every URL-based config and rebuilds the proxies.
+// A config that fails to load or validate keeps its previous snapshot.
+func refreshAll() error {
+	var lerr error
+	for name, refresh := range map[string]func() error{
+		"fence":     refreshFence,
+		"sites":     refreshSites,
+		"allowlist": refreshAllowlist,
+		"hosts":     refreshHosts,
+		"saml":      refreshSAML,
+		"jwks":      refreshJWKS,
+		"tokens":    refreshTokenProviders,
+		"certs":     refreshClientMap,
+		"accounts":  refreshAccounts,
+		"parties":   refreshFederateParties,
+		"aliases":   refreshUserAliases,
+		"stepup":    refreshStepUp,
+	} {
+		err := refresh()
+		if err != nil {
+			WithError(err).WithField("config", name).Error("refresh failed")
+			lerr = err
+		}
+	}
+	err := reproxy()
+	if err != nil {
+		lerr = err
+	}
+	return lerr
+}
+
+func refreshStart(interval time.Duration) {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	if refreshStop != nil {
+		close(refreshStop)
+		refreshStop = nil
+	}
+	if interval <= 0 {
+		return
+	}
+
+	refreshStop = make(chan struct{})
+	go refreshLoop(interval, refreshStop)
+}
+
+func refreshLoop(interval time.Duration, stop chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			refreshAll()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package beyond
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshSwap(t *testing.T) {
+	prevFence, prevSites := *fenceURL, *sitesURL
+	defer func() {
+		*fenceURL, *sitesURL = prevFence, prevSites
+		refreshFence()
+		refreshSites()
+		reproxy()
+	}()
+
+	dir := t.TempDir()
+	fenceFile := filepath.Join(dir, "fence.json")
+	sitesFile := filepath.Join(dir, "sites.json")
+	*fenceURL = "file://" + fenceFile
+	*sitesURL = "file://" + sitesFile
+
+	assert.NoError(t, os.WriteFile(fenceFile, []byte(`{"a@b.com": ["one"], "c@d.com": ["two"]}`), 0644))
+	assert.NoError(t, os.WriteFile(sitesFile, []byte(`{"one": ["https://one.refresh.test"], "two": ["https://two.refresh.test"]}`), 0644))
+	assert.NoError(t, refreshAll())
+	assert.Len(t, fence.m, 2)
+	_, ok := hostProxy.Load("two.refresh.test")
+	assert.True(t, ok)
+
+	// removals take effect
+	assert.NoError(t, os.WriteFile(fenceFile, []byte(`{"a@b.com": ["one"]}`), 0644))
+	assert.NoError(t, os.WriteFile(sitesFile, []byte(`{"one": ["https://one.refresh.test"]}`), 0644))
+	assert.NoError(t, refreshAll())
+	assert.Len(t, fence.m, 1)
+	assert.Nil(t, fence.m["c@d.com"])
+	_, ok = hostProxy.Load("two.refresh.test")
+	assert.False(t, ok)
+
+	// invalid snapshots keep the previous config
+	assert.NoError(t, os.WriteFile(sitesFile, []byte(`{"one": ["one.refresh.test"]}`), 0644))
+	assert.EqualError(t, refreshAll(), `invalid site URL: "one.refresh.test"`)
+	assert.True(t, sites.m["one"]["https://one.refresh.test"])
+
+	req, _ := http.NewRequest("GET", "https://two.refresh.test", nil)
+	assert.True(t, deny(req, "a@b.com"))
+	assert.False(t, deny(req, "c@d.com"))
+}
+
+func TestRefreshErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		w.Write([]byte(`{"message": "Not Found", "documentation_url": "https://docs.github.com"}`))
+	}))
+	defer server.Close()
+	defer func() {
+		*hostsURL = ""
+		hostsMap.m = map[string]string{}
+	}()
+
+	hostsMap.m = map[string]string{"old.refresh.test": "new.refresh.test"}
+	*hostsURL = server.URL
+	assert.EqualError(t, refreshHosts(), "unexpected config response: 404 Not Found")
+	assert.Equal(t, "new.refresh.test", hostRewrite("old.refresh.test"))
+
+	_, err := configOpen(server.URL)
+	assert.EqualError(t, err, "unexpected config response: 404 Not Found")
+}
+
+func TestRefreshStart(t *testing.T) {
+	refreshStart(time.Hour)
+	assert.NotNil(t, refreshStop)
+	refreshStart(0)
+	assert.Nil(t, refreshStop)
+}
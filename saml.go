@@ -8,6 +8,10 @@ import (
 	"flag"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlsp"
@@ -21,47 +25,84 @@ var (
 	samlKey  = flag.String("saml-key-file", "example/myservice.key", "SAML SP path to key.pem")
 
 	samlID  = flag.String("saml-entity-id", "", "SAML SP entity ID (blank defaults to beyond-host)")
-	samlIDP = flag.String("saml-metadata-url", "", "SAML metadata URL from IdP (blank disables SAML)")
+	samlIDP = flag.String("saml-metadata-url", "", "SAML metadata URL from IdP (blank with no saml-metadata-file disables SAML)")
+	samlIDF = flag.String("saml-metadata-file", "", "SAML metadata file from IdP, used when saml-metadata-url is blank or unreachable")
 
 	samlNIDF = flag.String("saml-nameid-format", "email", "SAML SP option: {email, persistent, transient, unspecified}")
 	samlAttr = flag.String("saml-session-key", "email", "SAML attribute to map from session")
+	samlGrps = flag.String("saml-groups-key", "memberOf", "SAML attribute to map group membership from (blank disables)")
 
 	samlSignRequests = flag.Bool("saml-sign-requests", false, "SAML SP signs authentication requests")
 	samlSignMethod   = flag.String("saml-signature-method", "", "SAML SP option: {sha1, sha256, sha512}")
 
 	samlSP *samlsp.Middleware
+	samlMu sync.RWMutex
 )
 
-func samlSetup() error {
-	if *samlIDP == "" {
-		return nil
+// samlAuthnInstant is the session attribute holding when the IdP
+// authenticated the user
+const samlAuthnInstant = "beyond-authn-instant"
+
+// samlSessionCodec keeps the AuthnInstant of the assertion in the SAML session
+type samlSessionCodec struct {
+	samlsp.SessionCodec
+}
+
+func (c samlSessionCodec) New(assertion *saml.Assertion) (samlsp.Session, error) {
+	s, err := c.SessionCodec.New(assertion)
+	claims, ok := s.(samlsp.JWTSessionClaims)
+	if err != nil || !ok {
+		return s, err
+	}
+	var instant time.Time
+	for _, statement := range assertion.AuthnStatements {
+		if statement.AuthnInstant.After(instant) {
+			instant = statement.AuthnInstant
+		}
 	}
-	if *samlID == "" {
-		*samlID = *host
+	delete(claims.Attributes, samlAuthnInstant)
+	if !instant.IsZero() {
+		claims.Attributes[samlAuthnInstant] = []string{strconv.FormatInt(instant.Unix(), 10)}
 	}
+	return claims, nil
+}
+
+func samlSetup() error {
+	var m *samlsp.Middleware
+	if *samlIDP != "" || *samlIDF != "" {
+		if *samlID == "" {
+			*samlID = *host
+		}
+		var err error
+		m, err = samlNew()
+		if err != nil {
+			return err
+		}
+	}
+	samlMu.Lock()
+	samlSP = m
+	samlMu.Unlock()
+	return nil
+}
 
+// samlNew builds the SP middleware with freshly loaded IdP metadata
+func samlNew() (*samlsp.Middleware, error) {
 	keyPair, err := tls.LoadX509KeyPair(*samlCert, *samlKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	keyPair.Leaf, err = x509.ParseCertificate(keyPair.Certificate[0])
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	idpMetadataURL, err := url.Parse(*samlIDP)
-	if err != nil {
-		return err
-	}
-	idpMetadata, err := samlsp.FetchMetadata(
-		context.Background(), http.DefaultClient,
-		*idpMetadataURL)
+	idpMetadata, err := samlMetadata()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rootURL, _ := url.Parse("https://" + *host)
-	samlSP, err = samlsp.New(samlsp.Options{
+	m, err := samlsp.New(samlsp.Options{
 		EntityID:    *samlID,
 		SignRequest: *samlSignRequests,
 		URL:         *rootURL,
@@ -71,58 +112,148 @@ func samlSetup() error {
 		Key:         keyPair.PrivateKey.(*rsa.PrivateKey),
 
 		AllowIDPInitiated: true,
+		LogoutBindings:    []string{saml.HTTPRedirectBinding, saml.HTTPPostBinding},
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if provider, ok := m.Session.(samlsp.CookieSessionProvider); ok {
+		provider.Codec = samlSessionCodec{provider.Codec}
+		m.Session = provider
 	}
 
 	switch *samlNIDF {
 	case "email":
-		samlSP.ServiceProvider.AuthnNameIDFormat = saml.EmailAddressNameIDFormat
+		m.ServiceProvider.AuthnNameIDFormat = saml.EmailAddressNameIDFormat
 	case "persistent":
-		samlSP.ServiceProvider.AuthnNameIDFormat = saml.PersistentNameIDFormat
+		m.ServiceProvider.AuthnNameIDFormat = saml.PersistentNameIDFormat
 	case "transient":
-		samlSP.ServiceProvider.AuthnNameIDFormat = saml.TransientNameIDFormat
+		m.ServiceProvider.AuthnNameIDFormat = saml.TransientNameIDFormat
 	case "unspecified":
-		samlSP.ServiceProvider.AuthnNameIDFormat = saml.UnspecifiedNameIDFormat
+		m.ServiceProvider.AuthnNameIDFormat = saml.UnspecifiedNameIDFormat
 	case "":
 	default:
-		return errors.Errorf("invalid saml-nameid-format: \"%s\"", *samlNIDF)
+		return nil, errors.Errorf("invalid saml-nameid-format: \"%s\"", *samlNIDF)
 	}
 
 	switch *samlSignMethod {
 	case "sha1":
-		samlSP.ServiceProvider.SignatureMethod = dsig.RSASHA1SignatureMethod
+		m.ServiceProvider.SignatureMethod = dsig.RSASHA1SignatureMethod
 	case "sha256":
-		samlSP.ServiceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
+		m.ServiceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
 	case "sha512":
-		samlSP.ServiceProvider.SignatureMethod = dsig.RSASHA512SignatureMethod
+		m.ServiceProvider.SignatureMethod = dsig.RSASHA512SignatureMethod
 	case "":
 	default:
-		return errors.Errorf("invalid saml-signature-method: \"%s\"", *samlSignMethod)
+		return nil, errors.Errorf("invalid saml-signature-method: \"%s\"", *samlSignMethod)
 	}
+	return m, nil
+}
+
+// samlMiddleware returns the current SP middleware, or nil when SAML is off
+func samlMiddleware() *samlsp.Middleware {
+	samlMu.RLock()
+	defer samlMu.RUnlock()
+	return samlSP
+}
+
+func handleSAML(w http.ResponseWriter, r *http.Request) {
+	samlMiddleware().ServeHTTP(w, r)
+}
+
+// samlMetadata loads IdP metadata from the URL, falling back to the file
+func samlMetadata() (*saml.EntityDescriptor, error) {
+	if *samlIDP != "" {
+		idpMetadataURL, err := url.Parse(*samlIDP)
+		if err != nil {
+			return nil, err
+		}
+		idpMetadata, err := samlsp.FetchMetadata(
+			context.Background(), http.DefaultClient,
+			*idpMetadataURL)
+		if err == nil || *samlIDF == "" {
+			return idpMetadata, err
+		}
+		WithError(err).WithField("file", *samlIDF).Error("saml metadata fetch failed")
+	}
+
+	data, err := os.ReadFile(*samlIDF)
+	if err != nil {
+		return nil, err
+	}
+	return samlsp.ParseMetadata(data)
+}
+
+// refreshSAML reloads IdP metadata to pick up signing certificate rotations.
+// It swaps in a new middleware, so logins in flight keep a consistent one.
+func refreshSAML() error {
+	if samlMiddleware() == nil {
+		return nil
+	}
+	m, err := samlNew()
+	if err != nil {
+		return err
+	}
+	samlMu.Lock()
+	samlSP = m
+	samlMu.Unlock()
 	return nil
 }
 
-func samlFilter(w http.ResponseWriter, r *http.Request) bool {
-	samlSession, _ := samlSP.Session.GetSession(r)
+// samlStartAuthFlow sends the user to the IdP, with ForceAuthn for a step-up
+func samlStartAuthFlow(w http.ResponseWriter, r *http.Request, force bool) {
+	sp := samlMiddleware()
+	if !force {
+		sp.HandleStartAuthFlow(w, r)
+		return
+	}
+	m := *sp
+	m.ServiceProvider.ForceAuthn = &force
+	m.HandleStartAuthFlow(w, r)
+}
+
+// samlFilter stores the user of a completed SAML login in the session. It
+// returns an error when the user fails the identity rules.
+func samlFilter(w http.ResponseWriter, r *http.Request) (bool, error) {
+	sp := samlMiddleware()
+	samlSession, _ := sp.Session.GetSession(r)
 	if _, ok := samlSession.(samlsp.SessionWithAttributes); !ok {
 		// sessions without mappings will redirect infinitely
-		return false
+		return false, nil
 	}
 	samlAttributes := samlSession.(samlsp.SessionWithAttributes).GetAttributes()
-	user := samlAttributes.Get(*samlAttr)
+	user := userNormalize(samlAttributes.Get(*samlAttr))
 	if user == "" {
 		// nil IdP assertion unlikely
-		return false
+		return false, nil
+	}
+	if err := userDomainAllowed(user); err != nil {
+		WithError(err).WithField("user", user).Info("login rejected")
+		sp.Session.DeleteSession(w, r)
+		return false, err
 	}
 
 	session, err := store.Get(r, *cookieName)
 	if err != nil {
 		session = store.New(*cookieName)
 	}
+	sessionRenew(session)
 	session.Values["user"] = user
+	authTime, _ := strconv.ParseInt(samlAttributes.Get(samlAuthnInstant), 10, 64)
+	if authTime == 0 {
+		authTime = time.Now().Unix()
+	}
+	session.Values["auth_time"] = authTime
+	sessionLogin(session)
+	if claims, ok := samlSession.(samlsp.JWTSessionClaims); ok {
+		// kept for Single Logout
+		session.Values["saml_nameid"] = claims.Subject
+	}
+	if *samlGrps != "" {
+		session.Values["groups"] = samlAttributes[*samlGrps]
+	}
 	session.Save(w)
-	samlSP.Session.DeleteSession(w, r)
-	return true
+	sp.Session.DeleteSession(w, r)
+	return true, nil
 }
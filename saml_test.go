@@ -1,5 +1,228 @@
 package beyond
 
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/gorilla/securecookie"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+)
+
 func init() {
 	// *samlIDP = "https://samltest.id/saml/idp"
 }
+
+const samlTestIDP = "https://idp.myorg.net/saml"
+
+func samlTestMetadata(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.myorg.net"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	md := saml.EntityDescriptor{
+		EntityID: samlTestIDP,
+		IDPSSODescriptors: []saml.IDPSSODescriptor{{
+			SSODescriptor: saml.SSODescriptor{
+				RoleDescriptor: saml.RoleDescriptor{
+					ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+					KeyDescriptors: []saml.KeyDescriptor{{
+						Use: "signing",
+						KeyInfo: saml.KeyInfo{X509Data: saml.X509Data{X509Certificates: []saml.X509Certificate{
+							{Data: base64.StdEncoding.EncodeToString(der)},
+						}}},
+					}},
+				},
+				SingleLogoutServices: []saml.Endpoint{{Binding: saml.HTTPRedirectBinding, Location: samlTestIDP + "/slo"}},
+			},
+			SingleSignOnServices: []saml.Endpoint{{Binding: saml.HTTPRedirectBinding, Location: samlTestIDP + "/sso"}},
+		}},
+	}
+	data, err := xml.Marshal(md)
+	assert.NoError(t, err)
+	*samlIDF = filepath.Join(t.TempDir(), "idp.xml")
+	assert.NoError(t, os.WriteFile(*samlIDF, data, 0600))
+	return key
+}
+
+// samlTestLogoutRequest signs a LogoutRequest with the HTTP-Redirect binding
+func samlTestLogoutRequest(t *testing.T, key *rsa.PrivateKey, nameID string) string {
+	req := saml.LogoutRequest{
+		ID:           "id-1",
+		Version:      "2.0",
+		IssueInstant: time.Now(),
+		Destination:  "https://" + *host + "/saml/slo",
+		Issuer:       &saml.Issuer{Value: samlTestIDP},
+		NameID:       &saml.NameID{Value: nameID},
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Element())
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, 9)
+	_, err := doc.WriteTo(fw)
+	assert.NoError(t, err)
+	fw.Close()
+
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(buf.Bytes())) +
+		"&RelayState=r1&SigAlg=" + url.QueryEscape(dsig.RSASHA256SignatureMethod)
+	digest := sha256.Sum256([]byte(query))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig))
+}
+
+func TestSAMLLogout(t *testing.T) {
+	prevIDF, prevLogout := *samlIDF, *logoutIDP
+	defer func() {
+		*samlIDF, *logoutIDP = prevIDF, prevLogout
+		samlSP = nil
+		store.backend = nil
+	}()
+	key := samlTestMetadata(t)
+	assert.NoError(t, samlSetup())
+	assert.NotNil(t, samlSP)
+	before := samlMiddleware()
+	assert.NoError(t, refreshSAML())
+	assert.NotSame(t, before, samlMiddleware())
+	assert.Equal(t, samlTestIDP, samlMiddleware().ServiceProvider.IDPMetadata.EntityID)
+
+	// refreshes swap the middleware while logins read it
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, refreshSAML())
+		}
+		close(done)
+	}()
+	for i := 0; i < 5; i++ {
+		certs, err := samlIDPCerts()
+		assert.NoError(t, err)
+		assert.Len(t, certs, 1)
+	}
+	<-done
+
+	// SP-initiated
+	*logoutIDP = true
+	end := logoutEndSession("", "cloud@user.com")
+	assert.True(t, strings.HasPrefix(end, samlTestIDP+"/slo?SAMLRequest="))
+	assert.Equal(t, "", logoutEndSession("", ""))
+
+	// IdP-initiated ends the browser session and the user's other sessions
+	store.backend = newMemorySessions()
+	other := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com"})
+	cookie := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com", "saml_nameid": "cloud@user.com"})
+
+	query := samlTestLogoutRequest(t, key, "cloud@user.com")
+	request := httptest.NewRequest("GET", "/saml/slo?"+query, nil)
+	request.Host = *host
+	request.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handleSAMLLogout(w, request)
+	resp := w.Result()
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Location"), samlTestIDP+"/slo?RelayState=r1&SAMLResponse="))
+	assert.Equal(t, -1, resp.Cookies()[0].MaxAge)
+
+	for _, c := range []*http.Cookie{cookie, other} {
+		request = httptest.NewRequest("GET", "/", nil)
+		request.AddCookie(c)
+		_, err := store.Get(request, *cookieName)
+		assert.Equal(t, errSessionNotFound, err)
+	}
+
+	// unsigned or tampered requests are rejected
+	request = httptest.NewRequest("GET", "/saml/slo?"+strings.Replace(query, "RelayState=r1", "RelayState=r2", 1), nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	handleSAMLLogout(w, request)
+	assert.Equal(t, 400, w.Result().StatusCode)
+
+	request = httptest.NewRequest("GET", "/saml/slo?"+strings.Split(query, "&Signature=")[0], nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	handleSAMLLogout(w, request)
+	assert.Equal(t, 400, w.Result().StatusCode)
+
+	// a signed request can't carry a second, forged message
+	victim := sessionTestCookie(t, map[string]interface{}{"user": "victim@user.com"})
+	forged := strings.Split(samlTestLogoutRequest(t, key, "victim@user.com"), "&")[0]
+	request = httptest.NewRequest("GET", "/saml/slo?"+forged+"&"+samlTestLogoutRequest(t, key, "attacker@user.com"), nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	handleSAMLLogout(w, request)
+	assert.Equal(t, 400, w.Result().StatusCode)
+	request = httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(victim)
+	_, err := store.Get(request, *cookieName)
+	assert.NoError(t, err)
+}
+
+func TestSAMLAuthnInstant(t *testing.T) {
+	prevIDF := *samlIDF
+	defer func() {
+		*samlIDF = prevIDF
+		samlSP = nil
+	}()
+	samlTestMetadata(t)
+	assert.NoError(t, samlSetup())
+
+	// the login keeps when the IdP authenticated the user
+	instant := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	assertion := &saml.Assertion{
+		Subject:         &saml.Subject{NameID: &saml.NameID{Value: "cloud@user.com"}},
+		AuthnStatements: []saml.AuthnStatement{{AuthnInstant: instant, SessionIndex: "s1"}},
+		AttributeStatements: []saml.AttributeStatement{{Attributes: []saml.Attribute{{
+			Name:   "email",
+			Values: []saml.AttributeValue{{Value: "cloud@user.com"}},
+		}}}},
+	}
+	request := httptest.NewRequest("GET", "/saml/acs", nil)
+	request.Host = *host
+	w := httptest.NewRecorder()
+	assert.NoError(t, samlMiddleware().Session.CreateSession(w, request, assertion))
+
+	request = httptest.NewRequest("GET", "/", nil)
+	request.Host = *host
+	for _, c := range w.Result().Cookies() {
+		request.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	ok, err := samlFilter(w, request)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	vals := map[string]interface{}{}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == *cookieName {
+			assert.NoError(t, securecookie.DecodeMulti(*cookieName, c.Value, &vals, store.Codecs...))
+		}
+	}
+	assert.Equal(t, "cloud@user.com", vals["user"])
+	assert.Equal(t, instant.Unix(), vals["auth_time"])
+}
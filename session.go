@@ -0,0 +1,378 @@
+package beyond
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dghubble/sessions"
+	"github.com/gorilla/securecookie"
+	cache "github.com/patrickmn/go-cache"
+)
+
+var (
+	sessionStorage = flag.String("session-store", "cookie", "session storage: {cookie, memory, redis}")
+	sessionRedis   = flag.String("session-redis", "localhost:6379", "redis address for server-side sessions (eg. redis://:password@localhost:6379/0)")
+	sessionAdmins  = flag.String("session-admins", "", "CSV of users allowed to list and revoke sessions")
+	sessionIdle    = flag.Duration("session-idle-timeout", 0, "end sessions without a request for this long (0 disables)")
+	sessionMaxAge  = flag.Duration("session-lifetime", 0, "end sessions this long after login, regardless of activity (0 disables)")
+
+	errSessionNotFound = errors.New("session not found")
+)
+
+// sessionBackend keeps session values server-side, keyed by an opaque ID
+type sessionBackend interface {
+	Load(id string) (map[string]interface{}, error)
+	Save(id, user string, values map[string]interface{}, ttl time.Duration) error
+	Delete(id string) error
+	List(user string) ([]string, error)
+	Revoke(user string) error
+}
+
+// sessionStore encodes values into the cookie, or only a session ID
+// when a server-side backend is configured
+type sessionStore struct {
+	*sessions.CookieStore
+	backend sessionBackend
+}
+
+func sessionSetup() error {
+	switch *sessionStorage {
+	case "cookie", "":
+		store.backend = nil
+	case "memory":
+		store.backend = newMemorySessions()
+	case "redis":
+		backend, err := newRedisSessions(*sessionRedis)
+		if err != nil {
+			return err
+		}
+		store.backend = backend
+	default:
+		return fmt.Errorf("invalid session-store: %q", *sessionStorage)
+	}
+	return nil
+}
+
+func (s *sessionStore) New(name string) *sessions.Session {
+	session := sessions.NewSession(s, name)
+	config := *s.Config
+	session.Config = &config
+	return session
+}
+
+func (s *sessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return nil, err
+	}
+	session := s.New(name)
+	if s.backend == nil {
+		err = securecookie.DecodeMulti(name, cookie.Value, &session.Values, s.Codecs...)
+		return session, err
+	}
+
+	var id string
+	err = securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+	values, err := s.backend.Load(id)
+	if err != nil {
+		return session, err
+	}
+	session.Values = values
+	session.Values["sid"] = id
+	return session, nil
+}
+
+func (s *sessionStore) Save(w http.ResponseWriter, session *sessions.Session) error {
+	if s.backend == nil {
+		return s.CookieStore.Save(w, session)
+	}
+
+	id, _ := session.Values["sid"].(string)
+	if session.Config.MaxAge < 0 {
+		if id != "" {
+			s.backend.Delete(id)
+		}
+		http.SetCookie(w, sessionCookie(session.Name(), "", session.Config))
+		return nil
+	}
+	if id == "" {
+		id, _ = randhex32()
+		session.Values["sid"] = id
+	}
+	user, _ := session.Values["user"].(string)
+	err := s.backend.Save(id, user, session.Values, time.Duration(session.Config.MaxAge)*time.Second)
+	if err != nil {
+		return err
+	}
+	cookieValue, err := securecookie.EncodeMulti(session.Name(), id, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessionCookie(session.Name(), cookieValue, session.Config))
+	return nil
+}
+
+// sessionReset clears a session's values but keeps its server-side ID
+func sessionReset(session *sessions.Session) {
+	id := session.Values["sid"]
+	session.Values = map[string]interface{}{}
+	if id != nil {
+		session.Values["sid"] = id
+	}
+}
+
+// sessionActive enforces -session-idle-timeout and -session-lifetime on a
+// signed-in session. Activity is saved at most once per minute (or a tenth of
+// the idle timeout) rather than on every request.
+func sessionActive(w http.ResponseWriter, session *sessions.Session) bool {
+	now := time.Now()
+	idle, ok := sessionLimits(session.Values, now)
+	if !ok {
+		return false
+	}
+	if *sessionIdle > 0 && idle >= min(*sessionIdle/10, time.Minute) {
+		session.Values["seen"] = now.Unix()
+		session.Save(w)
+	}
+	return true
+}
+
+// sessionLimits reports how long session values have been idle, and whether
+// they are within -session-idle-timeout and -session-lifetime
+func sessionLimits(values map[string]interface{}, now time.Time) (time.Duration, bool) {
+	login := sessionLoginTime(values)
+	if *sessionMaxAge > 0 && now.Sub(time.Unix(login, 0)) > *sessionMaxAge {
+		return 0, false
+	}
+	seen, _ := values["seen"].(int64)
+	if seen == 0 {
+		seen = login
+	}
+	idle := now.Sub(time.Unix(seen, 0))
+	return idle, *sessionIdle <= 0 || idle <= *sessionIdle
+}
+
+// sessionLoginTime is when the user logged in to beyond. Sessions from before
+// login_time was kept count from auth_time.
+func sessionLoginTime(values map[string]interface{}) int64 {
+	login, _ := values["login_time"].(int64)
+	if login == 0 {
+		login, _ = values["auth_time"].(int64)
+	}
+	return login
+}
+
+// sessionRenew issues a new ID on login to prevent session fixation
+func sessionRenew(session *sessions.Session) {
+	id, _ := session.Values["sid"].(string)
+	if id != "" && store.backend != nil {
+		store.backend.Delete(id)
+	}
+	delete(session.Values, "sid")
+	delete(session.Values, "csrf")
+}
+
+// sessionSameOrigin reports whether a state-changing request was sent from
+// beyond itself. The session cookie is SameSite=None, so requests that carry
+// neither Origin nor Sec-Fetch-Site are refused.
+func sessionSameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin == "https://"+*host
+	}
+	return r.Header.Get("Sec-Fetch-Site") == "same-origin"
+}
+
+// sessionLogin records a completed login. auth_time is when the IdP
+// authenticated the user, which may be earlier than the login to beyond that
+// the session limits count from.
+func sessionLogin(session *sessions.Session) {
+	now := time.Now().Unix()
+	session.Values["login_time"] = now
+	session.Values["seen"] = now
+}
+
+func sessionCookie(name, value string, config *sessions.Config) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   config.Domain,
+		Path:     config.Path,
+		MaxAge:   config.MaxAge,
+		HttpOnly: config.HTTPOnly,
+		Secure:   config.Secure,
+		SameSite: config.SameSite,
+	}
+	if config.MaxAge > 0 {
+		cookie.Expires = time.Now().Add(time.Duration(config.MaxAge) * time.Second)
+	} else if config.MaxAge < 0 {
+		cookie.Expires = time.Unix(1, 0)
+	}
+	return cookie
+}
+
+func sessionEncode(values map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(values)
+	return buf.Bytes(), err
+}
+
+func sessionDecode(b []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&values)
+	return values, err
+}
+
+// memorySessions is a single-instance sessionBackend
+type memorySessions struct {
+	sync.Mutex
+	values *cache.Cache
+	users  map[string]map[string]bool
+}
+
+func newMemorySessions() *memorySessions {
+	return &memorySessions{
+		values: cache.New(time.Duration(*cookieAge)*time.Second, 10*time.Minute),
+		users:  map[string]map[string]bool{},
+	}
+}
+
+type memorySession struct {
+	user string
+	data []byte
+}
+
+func (m *memorySessions) Load(id string) (map[string]interface{}, error) {
+	v, ok := m.values.Get(id)
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	return sessionDecode(v.(memorySession).data)
+}
+
+func (m *memorySessions) Save(id, user string, values map[string]interface{}, ttl time.Duration) error {
+	data, err := sessionEncode(values)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.values.Set(id, memorySession{user, data}, ttl)
+	if user != "" {
+		if m.users[user] == nil {
+			m.users[user] = map[string]bool{}
+		}
+		m.users[user][id] = true
+	}
+	return nil
+}
+
+func (m *memorySessions) Delete(id string) error {
+	m.values.Delete(id)
+	return nil
+}
+
+func (m *memorySessions) List(user string) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	ids := []string{}
+	for id := range m.users[user] {
+		if v, ok := m.values.Get(id); ok && v.(memorySession).user == user {
+			ids = append(ids, id)
+		} else {
+			delete(m.users[user], id)
+		}
+	}
+	return ids, nil
+}
+
+func (m *memorySessions) Revoke(user string) error {
+	ids, _ := m.List(user)
+	for _, id := range ids {
+		m.values.Delete(id)
+	}
+	m.Lock()
+	delete(m.users, user)
+	m.Unlock()
+	return nil
+}
+
+// handleSessions lists (GET ?user=) or revokes (POST sid= or user=) sessions
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	setCacheControl(w)
+	if store.backend == nil {
+		errorHandler(w, 501, "Server-side sessions are disabled")
+		return
+	}
+	session, err := store.Get(r, *cookieName)
+	if err != nil {
+		login(w, r)
+		return
+	}
+	admin, _ := session.Values["user"].(string)
+	if admin == "" {
+		login(w, r)
+		return
+	}
+	if !sessionAdmin(admin) {
+		errorHandler(w, 403, "Access Denied")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		user := r.URL.Query().Get("user")
+		ids, err := store.backend.List(user)
+		if err != nil {
+			errorHandler(w, 500, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "sessions": ids})
+
+	case http.MethodPost:
+		if !sessionSameOrigin(r) {
+			errorHandler(w, 403, "Invalid Origin")
+			return
+		}
+		sid, user := r.FormValue("sid"), r.FormValue("user")
+		switch {
+		case sid != "":
+			err = store.backend.Delete(sid)
+		case user != "":
+			err = store.backend.Revoke(user)
+		default:
+			errorHandler(w, 400, "sid or user is required")
+			return
+		}
+		if err != nil {
+			errorHandler(w, 500, err.Error())
+			return
+		}
+		WithFields(map[string]interface{}{"admin": admin, "sid": sid, "user": user}).Info("sessions revoked")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"revoked": true})
+
+	default:
+		errorHandler(w, 405, "")
+	}
+}
+
+func sessionAdmin(user string) bool {
+	for _, admin := range strings.Split(*sessionAdmins, ",") {
+		if admin != "" && admin == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package beyond
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func sessionTestCookie(t *testing.T, values map[string]interface{}) *http.Cookie {
+	session := store.New(*cookieName)
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	assert.NoError(t, session.Save(w))
+	return w.Result().Cookies()[0]
+}
+
+func TestSessionSetup(t *testing.T) {
+	defer func() {
+		*sessionStorage = "cookie"
+		assert.NoError(t, sessionSetup())
+	}()
+
+	*sessionStorage = "memory"
+	assert.NoError(t, sessionSetup())
+	assert.NotNil(t, store.backend)
+
+	*sessionStorage = "bogus"
+	assert.EqualError(t, sessionSetup(), `invalid session-store: "bogus"`)
+}
+
+func TestSessionMemory(t *testing.T) {
+	defer func() { store.backend = nil }()
+	store.backend = newMemorySessions()
+
+	cookie := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com", "groups": []string{"staff"}})
+
+	// the cookie only carries an opaque ID
+	var id string
+	assert.NoError(t, securecookie.DecodeMulti(*cookieName, cookie.Value, &id, store.Codecs...))
+	assert.Len(t, id, 64)
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(cookie)
+	session, err := store.Get(request, *cookieName)
+	assert.NoError(t, err)
+	assert.Equal(t, "cloud@user.com", session.Values["user"])
+	assert.Equal(t, []string{"staff"}, session.Values["groups"])
+	assert.Equal(t, id, session.Values["sid"])
+
+	ids, err := store.backend.List("cloud@user.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id}, ids)
+
+	// renewing on login replaces the ID
+	sessionRenew(session)
+	assert.NoError(t, session.Save(httptest.NewRecorder()))
+	assert.NotEqual(t, id, session.Values["sid"])
+	_, err = store.Get(request, *cookieName)
+	assert.Equal(t, errSessionNotFound, err)
+
+	cookie2 := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com"})
+	assert.NoError(t, store.backend.Revoke("cloud@user.com"))
+	request = httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(cookie2)
+	_, err = store.Get(request, *cookieName)
+	assert.Equal(t, errSessionNotFound, err)
+
+	// expiring a session deletes it
+	cookie3 := sessionTestCookie(t, map[string]interface{}{"user": "other@user.com"})
+	request = httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(cookie3)
+	session, err = store.Get(request, *cookieName)
+	assert.NoError(t, err)
+	sessionReset(session)
+	session.Config.MaxAge = -1
+	assert.NoError(t, session.Save(httptest.NewRecorder()))
+	_, err = store.Get(request, *cookieName)
+	assert.Equal(t, errSessionNotFound, err)
+}
+
+func TestSessionHandler(t *testing.T) {
+	request := httptest.NewRequest("GET", "/sessions?user=cloud@user.com", nil)
+	request.Host = *host
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 501, w.Result().StatusCode)
+
+	prevAdmins := *sessionAdmins
+	defer func() {
+		store.backend = nil
+		*sessionAdmins = prevAdmins
+	}()
+	store.backend = newMemorySessions()
+	*sessionAdmins = "admin@user.com,root@user.com"
+
+	user := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com"})
+	var userID string
+	assert.NoError(t, securecookie.DecodeMulti(*cookieName, user.Value, &userID, store.Codecs...))
+	admin := sessionTestCookie(t, map[string]interface{}{"user": "admin@user.com"})
+
+	request = httptest.NewRequest("GET", "/sessions?user=cloud@user.com", nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, *fouroOneCode, w.Result().StatusCode)
+
+	request = httptest.NewRequest("GET", "/sessions?user=cloud@user.com", nil)
+	request.Host = *host
+	request.AddCookie(user)
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	request = httptest.NewRequest("GET", "/sessions?user=cloud@user.com", nil)
+	request.Host = *host
+	request.AddCookie(admin)
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	v := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&v))
+	assert.Equal(t, []interface{}{userID}, v["sessions"])
+
+	// cross-site posts are refused
+	form := url.Values{"sid": {userID}}
+	request = httptest.NewRequest("POST", "/sessions", strings.NewReader(form.Encode()))
+	request.Host = *host
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Origin", "https://evil.example.com")
+	request.AddCookie(admin)
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	// posts need Origin or Sec-Fetch-Site from beyond itself
+	request = httptest.NewRequest("POST", "/sessions", strings.NewReader(form.Encode()))
+	request.Host = *host
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.AddCookie(admin)
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	request = httptest.NewRequest("POST", "/sessions", strings.NewReader(form.Encode()))
+	request.Host = *host
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Origin", "https://"+*host)
+	request.AddCookie(admin)
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	// the revoked cookie must login again
+	request = httptest.NewRequest("GET", "/test", nil)
+	request.Host = "github.com"
+	request.AddCookie(user)
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, *fouroOneCode, w.Result().StatusCode)
+
+	request = httptest.NewRequest("POST", "/sessions", nil)
+	request.Host = *host
+	request.Header.Set("Sec-Fetch-Site", "same-origin")
+	request.AddCookie(admin)
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 400, w.Result().StatusCode)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	defer func() { *sessionIdle, *sessionMaxAge = 0, 0 }()
+	*sessionIdle, *sessionMaxAge = 30*time.Minute, 12*time.Hour
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	sessionTest := func(authTime, seen time.Duration) *http.Response {
+		now := time.Now()
+		cookie := sessionTestCookie(t, map[string]interface{}{
+			"user":      "cloud@user.com",
+			"auth_time": now.Add(-authTime).Unix(),
+			"seen":      now.Add(-seen).Unix(),
+		})
+		request := httptest.NewRequest("GET", "/path?q=1", nil)
+		request.Host = backend.URL[7:]
+		request.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		testMux.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	// activity re-issues the cookie, but not on every request
+	resp := sessionTest(time.Hour, 10*time.Minute)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Len(t, resp.Cookies(), 1)
+	resp = sessionTest(time.Hour, 5*time.Second)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Empty(t, resp.Cookies())
+
+	// idle and old sessions log in again and come back
+	for _, resp := range []*http.Response{sessionTest(time.Hour, 31*time.Minute), sessionTest(13*time.Hour, 0)} {
+		assert.Equal(t, *fouroOneCode, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "/launch?next="+url.QueryEscape("https://"+backend.URL[7:]+"/path?q=1"))
+	}
+}
@@ -22,19 +22,21 @@ var (
 	healthPath  = flag.String("health-path", "/healthz/ping", "URL of the health endpoint")
 	healthReply = flag.String("health-reply", "ok", "response body of the health endpoint")
 
-	cookieAge  = flag.Int("cookie-age", 3600*6, "MaxAge setting in seconds")
-	cookieDom  = flag.String("cookie-domain", ".myorg.net", "session cookie domain")
-	cookieKey  = flag.String("cookie-key", "", `64-char hex key for cookie encryption (example: "t8yG1gmeEyeb7pQpw544UeCTyDfPkE6uQ599vrruZRhLFC144thCRZpyHM7qGDjt")`)
-	cookieName = flag.String("cookie-name", "beyond", "session cookie name")
+	cookieAge      = flag.Int("cookie-age", 3600*6, "MaxAge setting in seconds")
+	cookieDom      = flag.String("cookie-domain", ".myorg.net", "session cookie domain")
+	cookieKey      = flag.String("cookie-key", "", `64-char hex key for cookie encryption (example: "t8yG1gmeEyeb7pQpw544UeCTyDfPkE6uQ599vrruZRhLFC144thCRZpyHM7qGDjt")`)
+	cookieName     = flag.String("cookie-name", "beyond", "session cookie name")
+	cookieStripCSV = flag.String("cookie-strip", "", "comma-separated cookie names to remove before proxying, in addition to cookie-name")
 
 	fouroFourMessage = flag.String("404-message", "Please contact the application administrators to setup access.", "message to use when backend apps do not respond")
 	fouroOneCode     = flag.Int("401-code", 418, "status to respond when a user needs authentication")
 	headerPrefix     = flag.String("header-prefix", "Beyond", "prefix extra headers with this string")
+	headerStripCSV   = flag.String("header-strip", "", "comma-separated request headers to remove before proxying, in addition to those under header-prefix (eg. X-Forwarded-User,X-Remote-User)")
 
 	skipVerify = flag.Bool("insecure-skip-verify", false, "allow TLS backends without valid certificates")
 	wsCompress = flag.Bool("websocket-compression", false, "allow websocket transport compression (gorilla/experimental)")
 
-	store *sessions.CookieStore
+	store *sessionStore
 
 	tlsConfig = &tls.Config{}
 )
@@ -77,7 +79,7 @@ func Setup() error {
 	if err != nil {
 		return fmt.Errorf("cookie key must be valid hex: %v", err)
 	}
-	store = sessions.NewCookieStore(keyBytes, keyBytes)
+	store = &sessionStore{CookieStore: sessions.NewCookieStore(keyBytes, keyBytes)}
 	store.Config.Domain = *cookieDom
 	store.Config.MaxAge = *cookieAge
 	store.Config.HTTPOnly = true
@@ -105,10 +107,19 @@ func Setup() error {
 		ghpHosts[k] = true
 	}
 
-	err = dockerSetup(dURLs...)
+	err = sessionSetup()
+	if err == nil {
+		err = dockerSetup(dURLs...)
+	}
+	if err == nil {
+		err = signingSetup()
+	}
 	if err == nil {
 		err = federateSetup()
 	}
+	if err == nil {
+		err = refreshFederateParties()
+	}
 	if err == nil {
 		err = hostsSetup(*hostsCSV)
 	}
@@ -118,9 +129,27 @@ func Setup() error {
 	if err == nil {
 		err = logSetup()
 	}
+	if err == nil {
+		err = tokenJWTSetup()
+	}
+	if err == nil {
+		err = refreshTokenProviders()
+	}
+	if err == nil {
+		err = refreshClientMap()
+	}
+	if err == nil {
+		err = refreshAccounts()
+	}
+	if err == nil {
+		err = refreshUserAliases()
+	}
 	if err == nil {
 		err = oidcSetup(*oidcIssuer)
 	}
+	if err == nil {
+		err = oidcProvidersSetup()
+	}
 	if err == nil {
 		err = samlSetup()
 	}
@@ -133,8 +162,14 @@ func Setup() error {
 	if err == nil {
 		err = refreshAllowlist()
 	}
+	if err == nil {
+		err = refreshStepUp()
+	}
 	if err == nil {
 		err = reproxy()
 	}
+	if err == nil {
+		refreshStart(*refreshInterval)
+	}
 	return err
 }
@@ -0,0 +1,298 @@
+package beyond
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// handleSAMLLogout receives LogoutRequest (IdP-initiated) and
+// LogoutResponse (SP-initiated) messages at the SP's SLO URL
+func handleSAMLLogout(w http.ResponseWriter, r *http.Request) {
+	setCacheControl(w)
+	if r.URL.Query().Get("SAMLResponse") != "" || r.PostFormValue("SAMLResponse") != "" {
+		resp := &saml.LogoutResponse{}
+		err := samlLogoutMessage(r, "SAMLResponse", resp)
+		if err == nil {
+			err = samlLogoutCheck(resp.Issuer, resp.Destination, resp.IssueInstant, nil)
+		}
+		if err != nil {
+			WithError(err).Error("invalid SAML LogoutResponse")
+			errorHandler(w, 400, "Invalid Logout Response")
+			return
+		}
+		if resp.Status.StatusCode.Value != saml.StatusSuccess {
+			WithField("status", resp.Status.StatusCode.Value).Error("SAML logout failed at IdP")
+		}
+		// the session was reset before leaving; /logout resumes the saved next
+		http.Redirect(w, r, "https://"+*host+"/logout", http.StatusFound)
+		return
+	}
+
+	req := &saml.LogoutRequest{}
+	err := samlLogoutMessage(r, "SAMLRequest", req)
+	if err == nil {
+		err = samlLogoutCheck(req.Issuer, req.Destination, req.IssueInstant, req.NotOnOrAfter)
+	}
+	if err == nil && (req.NameID == nil || req.NameID.Value == "") {
+		err = errors.New("missing NameID")
+	}
+	if err != nil {
+		WithError(err).Error("invalid SAML LogoutRequest")
+		errorHandler(w, 400, "Invalid Logout Request")
+		return
+	}
+	samlEndSessions(w, r, req.NameID.Value)
+
+	sp := samlMiddleware().ServiceProvider
+	if sp.GetSLOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		http.Redirect(w, r, *homeURL, http.StatusFound)
+		return
+	}
+	u, err := sp.MakeRedirectLogoutResponse(req.ID, r.FormValue("RelayState"))
+	if err != nil {
+		Error(err)
+		errorHandler(w, 500, "Logout Response Failed")
+		return
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// samlEndSessions ends the browser's session and, with a server-side
+// store, every session of the logged out user
+func samlEndSessions(w http.ResponseWriter, r *http.Request, nameID string) {
+	users := []string{nameID}
+	session, err := store.Get(r, *cookieName)
+	if err == nil {
+		if id, _ := session.Values["saml_nameid"].(string); id == nameID {
+			if user, _ := session.Values["user"].(string); user != "" && user != nameID {
+				users = append(users, user)
+			}
+			sessionReset(session)
+			session.Config.MaxAge = -1
+			session.Save(w)
+		}
+	}
+	if store.backend != nil {
+		for _, user := range users {
+			err = store.backend.Revoke(user)
+			if err != nil {
+				WithError(err).WithField("user", user).Error("session revoke failed")
+			}
+		}
+	}
+	WithField("user", nameID).Info("SAML logout")
+}
+
+// samlLogoutURL starts SP-initiated logout for a SAML session
+func samlLogoutURL(nameID string) string {
+	if nameID == "" {
+		return ""
+	}
+	sp := samlMiddleware().ServiceProvider
+	if sp.GetSLOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return ""
+	}
+	u, err := sp.MakeRedirectLogoutRequest(nameID, "")
+	if err != nil {
+		Error(err)
+		return ""
+	}
+	return u.String()
+}
+
+func samlLogoutCheck(issuer *saml.Issuer, destination string, issued time.Time, notOnOrAfter *time.Time) error {
+	sp := samlMiddleware().ServiceProvider
+
+	now := saml.TimeNow()
+	switch {
+	case issuer == nil || issuer.Value != sp.IDPMetadata.EntityID:
+		return fmt.Errorf("issuer does not match the IdP metadata (expected %q)", sp.IDPMetadata.EntityID)
+	case destination != "" && destination != sp.SloURL.String():
+		return fmt.Errorf("destination does not match SloURL (expected %q)", sp.SloURL.String())
+	case issued.Add(saml.MaxIssueDelay).Before(now):
+		return fmt.Errorf("issueInstant expired at %s", issued.Add(saml.MaxIssueDelay))
+	case notOnOrAfter != nil && !now.Before(*notOnOrAfter):
+		return fmt.Errorf("expired at %s", *notOnOrAfter)
+	}
+	return nil
+}
+
+// samlLogoutMessage decodes and verifies a message sent with the
+// HTTP-Redirect (query signature) or HTTP-POST (XML signature) binding
+func samlLogoutMessage(r *http.Request, param string, v interface{}) error {
+	certs, err := samlIDPCerts()
+	if err != nil {
+		return err
+	}
+
+	values, err := samlQueryValues(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	if values[param] != "" {
+		// decode the same raw value the query signature covers
+		data, err := url.QueryUnescape(values[param])
+		if err != nil {
+			return err
+		}
+		compressed, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return err
+		}
+		raw, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), 1<<20))
+		if err != nil {
+			return err
+		}
+		err = doc.ReadFromBytes(raw)
+		if err != nil {
+			return err
+		}
+		if samlVerifyQuery(values, param, certs) == nil {
+			return samlUnmarshal(doc.Root(), v)
+		}
+	} else {
+		raw, err := base64.StdEncoding.DecodeString(r.PostFormValue(param))
+		if err != nil {
+			return err
+		}
+		err = doc.ReadFromBytes(raw)
+		if err != nil {
+			return err
+		}
+	}
+	if doc.Root() == nil {
+		return errors.New("empty message")
+	}
+
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+	validationContext.IdAttribute = "ID"
+	el, err := validationContext.Validate(doc.Root())
+	if err != nil {
+		return err
+	}
+	return samlUnmarshal(el, v)
+}
+
+// samlQueryValues splits a raw query without unescaping it. The parameters
+// of the HTTP-Redirect binding may appear only once, so the message that is
+// processed is the one that was signed.
+func samlQueryValues(rawQuery string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, part := range strings.Split(rawQuery, "&") {
+		k, v, _ := strings.Cut(part, "=")
+		if _, ok := values[k]; ok {
+			switch k {
+			case "SAMLRequest", "SAMLResponse", "RelayState", "SigAlg", "Signature":
+				return nil, fmt.Errorf("repeated %s parameter", k)
+			}
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+// samlVerifyQuery checks the detached signature of the HTTP-Redirect binding
+func samlVerifyQuery(values map[string]string, param string, certs []*x509.Certificate) error {
+	if values["Signature"] == "" {
+		return errors.New("missing signature")
+	}
+
+	signed := param + "=" + values[param]
+	if relayState, ok := values["RelayState"]; ok {
+		signed += "&RelayState=" + relayState
+	}
+	signed += "&SigAlg=" + values["SigAlg"]
+
+	sigAlg, err := url.QueryUnescape(values["SigAlg"])
+	if err != nil {
+		return err
+	}
+	var hash crypto.Hash
+	switch sigAlg {
+	case dsig.RSASHA1SignatureMethod:
+		hash = crypto.SHA1
+	case dsig.RSASHA256SignatureMethod:
+		hash = crypto.SHA256
+	case dsig.RSASHA512SignatureMethod:
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported SigAlg: %q", sigAlg)
+	}
+	signature, err := url.QueryUnescape(values["Signature"])
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	for _, cert := range certs {
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// samlIDPCerts returns the IdP signing certificates from its metadata
+func samlIDPCerts() ([]*x509.Certificate, error) {
+	idpMetadata := samlMiddleware().ServiceProvider.IDPMetadata
+
+	certs := []*x509.Certificate{}
+	for _, idp := range idpMetadata.IDPSSODescriptors {
+		for _, key := range idp.KeyDescriptors {
+			if key.Use != "" && key.Use != "signing" {
+				continue
+			}
+			for _, c := range key.KeyInfo.X509Data.X509Certificates {
+				der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(c.Data), ""))
+				if err != nil {
+					return nil, err
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, err
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if len(certs) < 1 {
+		return nil, errors.New("no IdP signing certificates in metadata")
+	}
+	return certs, nil
+}
+
+func samlUnmarshal(el *etree.Element, v interface{}) error {
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
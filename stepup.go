@@ -0,0 +1,105 @@
+package beyond
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	stepUpURL = flag.String("step-up-url", "", "URL or file of the max auth age of sites and zones (eg. https://github.com/myorg/beyond-config/main/raw/stepup.json)")
+
+	stepUp = concurrentMapDuration{m: map[string]time.Duration{}}
+)
+
+type concurrentMapDuration struct {
+	sync.RWMutex
+	m map[string]time.Duration
+}
+
+func refreshStepUp() error {
+	if *stepUpURL == "" {
+		return nil
+	}
+
+	body, err := configOpen(*stepUpURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	d := map[string]string{}
+	err = json.NewDecoder(body).Decode(&d)
+	if err != nil {
+		return err
+	}
+
+	m := map[string]time.Duration{}
+	for k, v := range d {
+		maxAge, err := time.ParseDuration(v)
+		if k == "" || err != nil || maxAge < time.Second {
+			return fmt.Errorf("invalid max auth age: %q=%q", k, v)
+		}
+		m[k] = maxAge
+	}
+
+	stepUp.Lock()
+	stepUp.m = m
+	stepUp.Unlock()
+	return nil
+}
+
+// stepUpMaxAge is the strictest max auth age of a host's site and of every
+// zone that lists it, or 0 when there is none
+func stepUpMaxAge(host string) time.Duration {
+	stepUp.RLock()
+	m := stepUp.m
+	stepUp.RUnlock()
+	if len(m) < 1 {
+		return 0
+	}
+
+	var maxAge time.Duration
+	limit := func(d time.Duration) {
+		if d > 0 && (maxAge == 0 || d < maxAge) {
+			maxAge = d
+		}
+	}
+	limit(m["https://"+host])
+	limit(m["http://"+host])
+
+	sites.RLock()
+	s := sites.m
+	sites.RUnlock()
+	for zone, v := range s {
+		if v["https://"+host] || v["http://"+host] {
+			limit(m[zone])
+		}
+	}
+	return maxAge
+}
+
+// stepUpRequired reports whether a login at authTime is too old for the site
+func stepUpRequired(r *http.Request, authTime int64) (time.Duration, bool) {
+	maxAge := stepUpMaxAge(r.Host)
+	return maxAge, maxAge > 0 && time.Since(time.Unix(authTime, 0)) > maxAge
+}
+
+// stepUpLogin sends the user to log in again, even with a live IdP session
+func stepUpLogin(w http.ResponseWriter, r *http.Request, maxAge time.Duration) {
+	loginQuery(w, r, url.Values{"max_age": []string{strconv.Itoa(int(maxAge.Seconds()))}})
+}
+
+// stepUpLaunch reads the max_age a /launch must satisfy
+func stepUpLaunch(r *http.Request) int {
+	maxAge, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get("max_age")))
+	if err != nil || maxAge < 0 {
+		return 0
+	}
+	return maxAge
+}
@@ -0,0 +1,122 @@
+package beyond
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestStepUp(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendHost := backend.URL[7:]
+
+	prevURL, prevConfig := *stepUpURL, oidcConfig
+	defer func() {
+		*stepUpURL, oidcConfig = prevURL, prevConfig
+		stepUp.m = map[string]time.Duration{}
+		sites.Lock()
+		delete(sites.m, "console")
+		sites.Unlock()
+	}()
+	sites.Lock()
+	sites.m["console"] = map[string]bool{backend.URL: true}
+	sites.Unlock()
+
+	path := filepath.Join(t.TempDir(), "stepup.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"console": "15m", "`+backend.URL+`": "1h", "https://prod.myorg.net": "5m"}`), 0600))
+	*stepUpURL = path
+	assert.NoError(t, refreshStepUp())
+	assert.Equal(t, 15*time.Minute, stepUpMaxAge(backendHost))
+	assert.Equal(t, 5*time.Minute, stepUpMaxAge("prod.myorg.net"))
+	assert.Equal(t, time.Duration(0), stepUpMaxAge("other.myorg.net"))
+
+	stepUpTest := func(authTime time.Duration) *httptest.ResponseRecorder {
+		cookie := sessionTestCookie(t, map[string]interface{}{"user": "cloud@user.com", "auth_time": time.Now().Add(-authTime).Unix()})
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Host = backendHost
+		request.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		testMux.ServeHTTP(w, request)
+		return w
+	}
+	assert.Equal(t, 200, stepUpTest(10*time.Minute).Code)
+	w := stepUpTest(20 * time.Minute)
+	assert.Equal(t, *fouroOneCode, w.Code)
+	assert.Contains(t, w.Body.String(), "/launch?max_age=900&amp;next=")
+
+	// the IdP is asked for a fresh login
+	oidcConfig = &oauth2ConfigWrapper{&oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: oidcServer.URL + "/authorize"},
+	}}
+	request := httptest.NewRequest("GET", "/launch?max_age=900&next=https%3A%2F%2Fconsole.myorg.net%2F", nil)
+	request.Host = *host
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Contains(t, w.Body.String(), "max_age=900")
+	assert.Contains(t, w.Body.String(), "prompt=login")
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"console": "soon"}`), 0600))
+	assert.EqualError(t, refreshStepUp(), `invalid max auth age: "console"="soon"`)
+}
+
+func TestStepUpCallback(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	prevConfig, prevVerifier := oidcConfig, oidcVerifier
+	defer func() {
+		oidcConfig, oidcVerifier = prevConfig, prevVerifier
+		oidcMockAuthTime, *sessionMaxAge = 0, 0
+	}()
+	mock := &oidcMock{}
+	oidcConfig = mock
+	oidcVerifier = mock
+	*sessionMaxAge = time.Hour
+
+	callback := func(maxAge int, authTime int64) *httptest.ResponseRecorder {
+		oidcMockAuthTime = authTime
+		cookie := sessionTestCookie(t, map[string]interface{}{"state": "barbaz", "nonce": "nonce1", "next": "https://" + *host + "/next", "max_age": maxAge})
+		request := httptest.NewRequest("GET", "/oidc?state=barbaz", nil)
+		request.Host = *host
+		request.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		testMux.ServeHTTP(w, request)
+		return w
+	}
+
+	// a step-up needs the IdP to say when the user authenticated
+	for _, authTime := range []int64{0, time.Now().Add(-20 * time.Minute).Unix()} {
+		w := callback(900, authTime)
+		assert.Equal(t, 401, w.Code)
+		assert.Contains(t, w.Body.String(), "Re-authentication Required")
+	}
+	recent := time.Now().Add(-time.Minute).Unix()
+	w := callback(900, recent)
+	assert.Equal(t, 302, w.Code)
+	vals := map[string]interface{}{}
+	assert.NoError(t, securecookie.DecodeMulti(*cookieName, w.Result().Cookies()[0].Value, &vals, store.Codecs...))
+	assert.Equal(t, recent, vals["auth_time"])
+
+	// an older IdP login is kept as auth_time, and the session still starts now
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	w = callback(0, old)
+	assert.Equal(t, 302, w.Code)
+	cookie := w.Result().Cookies()[0]
+	vals = map[string]interface{}{}
+	assert.NoError(t, securecookie.DecodeMulti(*cookieName, cookie.Value, &vals, store.Codecs...))
+	assert.Equal(t, old, vals["auth_time"])
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = backend.URL[7:]
+	request.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 200, w.Code)
+}
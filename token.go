@@ -3,19 +3,34 @@ package beyond
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	cache "github.com/patrickmn/go-cache"
 )
 
+const (
+	tokenCacheTTL = 10 * time.Minute
+
+	// tokenGQLTeams lists a GitHub viewer's orgs and teams
+	tokenGQLTeams = `query($login: String!) { viewer { organizations(first: 100) { nodes { login teams(first: 100, userLogins: [$login]) { nodes { slug } } } } } }`
+)
+
 var (
 	tokenBase = flag.String("token-base", "", "token server URL prefix (eg. https://api.github.com/user)")
 	tokenGQL  = flag.String("token-graphql", "", "GraphQL URL for auth (eg. https://api.github.com/graphql)")
 	tokenGQLQ = flag.String("token-graphql-query", `{"query": "query { viewer { login }}"}`, "")
+	tokenGQLT = flag.String("token-graphql-teams", "", "GraphQL query for the viewer's orgs and teams, mapped to org: and team: fence principals; tokens need read:org (blank disables, eg. "+tokenGQLTeams+")")
 
-	tokenCache = cache.New(10*time.Minute, 10*time.Minute)
+	tokenProvidersURL = flag.String("token-providers-url", "", "URL to token providers config, tried in order after -token-graphql/-token-base")
+
+	tokenCache = cache.New(tokenCacheTTL, 10*time.Minute)
+
+	tokenProviders = tokenProviderList{}
 
 	tokenTypes = map[string]bool{
 		"bearer": true,
@@ -23,13 +38,92 @@ var (
 	}
 )
 
+// tokenProvider is an API that resolves a bearer token to its user
+type tokenProvider struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Method string `json:"method"`
+	Body   string `json:"body"`
+	User   string `json:"user"`
+	Prefix string `json:"prefix"`
+	Suffix string `json:"suffix"`
+	Teams  string `json:"teams"`
+}
+
+// tokenIdentity is a token's user and its extra fence principals
+type tokenIdentity struct {
+	User       string
+	Principals []string
+}
+
+type tokenProviderList struct {
+	sync.RWMutex
+	list []*tokenProvider
+}
+
 // {"data":{"viewer":{"login":"github[bot]"}}}
 
 func tokenAuth(r *http.Request) string {
-	if *tokenBase == "" && *tokenGQL == "" {
-		return ""
+	user, _ := tokenIdentify(r)
+	return user
+}
+
+// tokenIdentify returns the user of a request's token and its principals
+func tokenIdentify(r *http.Request) (string, []string) {
+	providers := tokenProvidersList()
+	if len(providers) < 1 && *tokenIntrospect == "" && tokenJWTVerifier == nil {
+		return "", nil
+	}
+
+	token := tokenFromRequest(r)
+	if token == "" {
+		return "", nil
+	}
+	if tokenJWTVerifier != nil && strings.Count(token, ".") == 2 {
+		return tokenJWT(token), nil
+	}
+	if len(providers) < 1 && *tokenIntrospect == "" {
+		return "", nil
 	}
 
+	if v, ex := tokenCache.Get(token); ex {
+		if v, ok := v.(tokenIdentity); ok {
+			return v.User, v.Principals
+		}
+	}
+
+	failed := false
+	if *tokenIntrospect != "" {
+		user, ttl, err := tokenIntrospection(token)
+		switch {
+		case err != nil:
+			WithError(err).WithField("provider", "introspect").Error("token lookup failed")
+			failed = true
+		case user != "":
+			tokenCache.Set(token, tokenIdentity{User: user}, ttl)
+			return user, nil
+		}
+	}
+	for _, p := range providers {
+		id, err := p.lookup(token)
+		if err != nil {
+			WithError(err).WithField("provider", p.Name).Error("token lookup failed")
+			failed = true
+			continue
+		}
+		if id.User != "" {
+			tokenCache.Set(token, id, cache.DefaultExpiration)
+			return id.User, id.Principals
+		}
+	}
+	if !failed {
+		tokenCache.Set(token, tokenIdentity{}, cache.DefaultExpiration)
+	}
+	return "", nil
+}
+
+// tokenFromRequest reads a token from basic auth, access_token or Authorization
+func tokenFromRequest(r *http.Request) string {
 	u, token, ok := r.BasicAuth()
 	if ok && (token == "x-oauth-basic" || token == "") {
 		token = u
@@ -43,71 +137,164 @@ func tokenAuth(r *http.Request) string {
 			token = parts[1]
 		}
 	}
-	if token == "" {
-		return ""
-	}
+	return token
+}
 
-	if v, ex := tokenCache.Get(token); ex {
-		if v, ok := v.(string); ok {
-			return v
-		}
+// tokenProvidersList returns the flag providers followed by the configured ones
+func tokenProvidersList() []*tokenProvider {
+	providers := []*tokenProvider{}
+	switch {
+	case *tokenGQL != "":
+		providers = append(providers, &tokenProvider{Name: "graphql", URL: *tokenGQL, Method: "POST", Body: *tokenGQLQ, User: "data.viewer.login", Teams: *tokenGQLT})
+	case *tokenBase != "":
+		providers = append(providers, &tokenProvider{Name: "base", URL: *tokenBase, User: "login"})
 	}
+	tokenProviders.RLock()
+	providers = append(providers, tokenProviders.list...)
+	tokenProviders.RUnlock()
+	return providers
+}
 
-	var (
-		req *http.Request
-		err error
-	)
+func refreshTokenProviders() error {
+	if *tokenProvidersURL == "" {
+		return nil
+	}
 
-	switch {
-	case *tokenGQL != "":
-		req, err = http.NewRequest("POST", *tokenGQL, strings.NewReader(*tokenGQLQ))
-		if err != nil {
-			Error(err)
-			return ""
+	resp, err := httpACLGet(*tokenProvidersURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	list := []*tokenProvider{}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return err
+	}
+	for _, p := range list {
+		if p.URL == "" || p.User == "" {
+			return fmt.Errorf("token provider %q requires url and user", p.Name)
 		}
+	}
+	tokenProviders.Lock()
+	tokenProviders.list = list
+	tokenProviders.Unlock()
+	return nil
+}
 
-	default:
-		req, err = http.NewRequest("GET", *tokenBase, nil)
+// lookup returns the token's identity, with no user when the provider rejects it
+func (p *tokenProvider) lookup(token string) (tokenIdentity, error) {
+	id := tokenIdentity{}
+	var v interface{}
+	ok, err := p.do(token, p.Method, p.Body, &v)
+	if !ok || err != nil {
+		return id, err
+	}
+	login := tokenPath(v, p.User)
+	if login == "" {
+		return id, nil
+	}
+	if p.Teams != "" {
+		// a failed lookup would leave the user less fenced, so it fails closed
+		id.Principals, err = p.teams(token, login)
 		if err != nil {
-			Error(err)
-			return ""
+			return id, err
 		}
+	}
+	id.User = p.Prefix + login + p.Suffix
+	return id, nil
+}
+
+// teams lists org: and team: principals with a GitHub-style GraphQL query
+func (p *tokenProvider) teams(token, login string) ([]string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query":     p.Teams,
+		"variables": map[string]string{"login": login},
+	})
+	if err != nil {
+		return nil, err
+	}
+	v := &gqlTeams{}
+	ok, err := p.do(token, "POST", string(body), v)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || len(v.Errors) > 0 {
+		return nil, fmt.Errorf("teams query failed for %s", login)
+	}
 
+	principals := []string{}
+	for _, org := range v.Data.Viewer.Organizations.Nodes {
+		principals = append(principals, "org:"+org.Login)
+		for _, team := range org.Teams.Nodes {
+			principals = append(principals, "team:"+org.Login+"/"+team.Slug)
+		}
 	}
+	return principals, nil
+}
 
+// do sends one request with the token and decodes a 200 response into v
+func (p *tokenProvider) do(token, method, body string, v interface{}) (bool, error) {
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, p.URL, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
 	req.Header.Set("Authorization", "Bearer "+token)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		Error(err)
-		return ""
+		return false, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		tokenCache.Set(token, "", cache.DefaultExpiration)
-		return ""
+		return false, nil
 	}
 
-	switch {
-	case *tokenGQL != "":
-		v := new(gqlResponse)
-		err = json.NewDecoder(resp.Body).Decode(v)
-		if err != nil {
-			Error(err)
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	return true, dec.Decode(v)
+}
+
+// tokenPath walks a dotted path (eg. data.viewer.login) to a string or number
+func tokenPath(v interface{}, path string) string {
+	for _, k := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = tokenField(node, k)
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
 			return ""
 		}
-		tokenCache.Set(token, v.Data.Viewer.Login, cache.DefaultExpiration)
-		return v.Data.Viewer.Login
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
 
-	default:
-		v := &tokenUser{}
-		err = json.NewDecoder(resp.Body).Decode(v)
-		if err != nil {
-			Error(err)
-			return ""
+// tokenField matches keys case-insensitively, like encoding/json
+func tokenField(m map[string]interface{}, k string) interface{} {
+	if v, ok := m[k]; ok {
+		return v
+	}
+	for key, v := range m {
+		if strings.EqualFold(key, k) {
+			return v
 		}
-		tokenCache.Set(token, v.Login, cache.DefaultExpiration)
-		return v.Login
 	}
+	return nil
 }
 
 type tokenUser struct {
@@ -115,10 +302,20 @@ type tokenUser struct {
 	Email string
 }
 
-type gqlResponse struct {
+type gqlTeams struct {
 	Data struct {
 		Viewer struct {
-			Login string `json:"login"`
+			Organizations struct {
+				Nodes []struct {
+					Login string `json:"login"`
+					Teams struct {
+						Nodes []struct {
+							Slug string `json:"slug"`
+						} `json:"nodes"`
+					} `json:"teams"`
+				} `json:"nodes"`
+			} `json:"organizations"`
 		} `json:"viewer"`
 	} `json:"data"`
+	Errors []interface{} `json:"errors"`
 }
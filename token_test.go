@@ -140,3 +140,125 @@ func TestTokenSuccess(t *testing.T) {
 	assert.Equal(t, 403, resp.StatusCode)
 	assert.Contains(t, string(body), "Access Denied")
 }
+
+func TestTokenProviders(t *testing.T) {
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer glpat-1" {
+			w.WriteHeader(401)
+			return
+		}
+		io.WriteString(w, `{"id": 42, "username": "user1", "identities": [{"extern_uid": "uid-1"}]}`)
+	}))
+	defer gitlab.Close()
+	gitea := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, `{"q": 1}`, string(body))
+		if r.Header.Get("Authorization") != "Bearer gitea-1" {
+			w.WriteHeader(401)
+			return
+		}
+		io.WriteString(w, `{"data": {"user": {"login": "user1"}}}`)
+	}))
+	defer gitea.Close()
+
+	prevBase, prevURL := *tokenBase, *tokenProvidersURL
+	defer func() {
+		*tokenBase, *tokenProvidersURL = prevBase, prevURL
+		tokenProviders.list = nil
+	}()
+	*tokenBase = ""
+
+	config := `[
+		{"name": "gitlab", "url": "` + gitlab.URL + `", "user": "username", "suffix": "@gitlab"},
+		{"name": "gitlab-uid", "url": "` + gitlab.URL + `", "user": "identities.0.extern_uid", "prefix": "gitlab:"},
+		{"name": "gitea", "url": "` + gitea.URL + `", "method": "POST", "body": "{\"q\": 1}", "user": "data.user.login", "suffix": "@gitea"}
+	]`
+	path := t.TempDir() + "/tokens.json"
+	assert.NoError(t, os.WriteFile(path, []byte(config), 0600))
+	*tokenProvidersURL = "file://" + path
+	assert.NoError(t, refreshTokenProviders())
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer glpat-1")
+	assert.Equal(t, "user1@gitlab", tokenAuth(r))
+	r.Header.Set("Authorization", "Bearer gitea-1")
+	assert.Equal(t, "user1@gitea", tokenAuth(r))
+	r.Header.Set("Authorization", "Bearer unknown-1")
+	assert.Equal(t, "", tokenAuth(r))
+
+	assert.Equal(t, "uid-1", tokenPath(map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": "uid-1"}}}, "a.0.b"))
+	assert.Equal(t, "", tokenPath(map[string]interface{}{"a": []interface{}{}}, "a.1"))
+
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"name": "broken"}]`), 0600))
+	assert.EqualError(t, refreshTokenProviders(), `token provider "broken" requires url and user`)
+	assert.Len(t, tokenProvidersList(), 3)
+}
+
+func TestTokenGraphQLTeams(t *testing.T) {
+	teamsFailed := false
+	gql := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ghp-teams" {
+			w.WriteHeader(401)
+			return
+		}
+		v := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&v))
+		if v["variables"] == nil {
+			io.WriteString(w, `{"data":{"viewer":{"login":"bot1"}}}`)
+			return
+		}
+		assert.Equal(t, map[string]interface{}{"login": "bot1"}, v["variables"])
+		if teamsFailed {
+			io.WriteString(w, `{"errors":[{"message":"rate limited"}]}`)
+			return
+		}
+		io.WriteString(w, `{"data":{"viewer":{"organizations":{"nodes":[
+			{"login":"myorg","teams":{"nodes":[{"slug":"platform"},{"slug":"contractors"}]}},
+			{"login":"otherorg","teams":{"nodes":[]}}
+		]}}}}`)
+	}))
+	defer gql.Close()
+
+	prevBase, prevGQL, prevTeams := *tokenBase, *tokenGQL, *tokenGQLT
+	prevFence := fence.m
+	defer func() {
+		*tokenBase, *tokenGQL, *tokenGQLT = prevBase, prevGQL, prevTeams
+		fence.m = prevFence
+	}()
+	*tokenGQL = gql.URL
+	tokenCache.Delete("ghp-teams")
+
+	// off by default
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer ghp-teams")
+	user, principals := tokenIdentify(r)
+	assert.Equal(t, "bot1", user)
+	assert.Empty(t, principals)
+
+	*tokenGQLT = tokenGQLTeams
+	tokenCache.Delete("ghp-teams")
+	user, principals = tokenIdentify(r)
+	assert.Equal(t, "bot1", user)
+	assert.Equal(t, []string{"org:myorg", "team:myorg/platform", "team:myorg/contractors", "org:otherorg"}, principals)
+
+	// cached with the login
+	teamsFailed = true
+	user, principals = tokenIdentify(r)
+	assert.Equal(t, "bot1", user)
+	assert.Len(t, principals, 4)
+
+	// team fence entries apply to token users
+	fence.m = map[string]map[string]bool{"team:myorg/contractors": {"test": true}}
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "Bearer ghp-teams")
+	request.Host = "github.com"
+	w := httptest.NewRecorder()
+	testMux.ServeHTTP(w, request)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	// a failed teams query fails closed
+	tokenCache.Delete("ghp-teams")
+	user, _ = tokenIdentify(r)
+	assert.Equal(t, "", user)
+}
@@ -20,11 +20,23 @@ func NewMux() http.Handler {
 
 	mux.HandleFunc(*host+"/federate", federate)
 	mux.HandleFunc(*host+"/federate/verify", federateVerify)
+	mux.HandleFunc(*host+"/.well-known/jwks.json", handleJWKS)
 
 	mux.HandleFunc(*host+"/launch", handleLaunch)
 	mux.HandleFunc(*host+"/oidc", handleOIDC)
-	if samlSP != nil {
-		mux.HandleFunc(*host+"/saml/", samlSP.ServeHTTP)
+	mux.HandleFunc(*host+"/logout", handleLogout)
+	mux.HandleFunc(*host+"/sessions", handleSessions)
+	if *deviceFlow {
+		mux.HandleFunc(*host+"/device", handleDevice)
+		mux.HandleFunc(*host+"/device/code", handleDeviceCode)
+		mux.HandleFunc(*host+"/device/token", handleDeviceToken)
+	}
+	if *cliLogin {
+		mux.HandleFunc(*host+"/token", handleToken)
+	}
+	if samlMiddleware() != nil {
+		mux.HandleFunc(*host+"/saml/slo", handleSAMLLogout)
+		mux.HandleFunc(*host+"/saml/", handleSAML)
 	}
 	mux.Handle(*host+"/", http.RedirectHandler(*homeURL, http.StatusTemporaryRedirect))
 